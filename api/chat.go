@@ -1,28 +1,24 @@
 package api
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/rubleowen/GetMerlin2Api/auth"
-)
-
-var (
-	tokenCache      string
-	tokenExpiry     time.Time
-	tokenMutex      sync.Mutex
-	requestCache    = make(map[string]ImageGenerationResult)
-	requestCacheMux sync.RWMutex
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/profile"
+	"github.com/rubleowen/GetMerlin2Api/tracing"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
 )
 
 type OpenAIRequest struct {
@@ -40,11 +36,12 @@ type Message struct {
 }
 
 type ChatRequest struct {
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Model       string    `json:"model"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
+	Messages      []Message      `json:"messages"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	Model         string         `json:"model"`
+	MaxTokens     int            `json:"max_tokens,omitempty"`
+	Temperature   float64        `json:"temperature,omitempty"`
 }
 
 type Delta struct {
@@ -52,18 +49,59 @@ type Delta struct {
 	Role    string `json:"role,omitempty"`
 }
 
-type Choice struct {
-	Delta        Delta  `json:"delta"`
-	Index        int    `json:"index"`
-	FinishReason string `json:"finish_reason,omitempty"`
+// MarshalJSON 与 OpenAI 一致：只有角色的第一块带空的 content，其他块省略空字段
+func (d Delta) MarshalJSON() ([]byte, error) {
+	if d.Role != "" && d.Content == "" {
+		return json.Marshal(struct {
+			Role    string `json:"role"`
+			Content string `json:"content"`
+		}{d.Role, d.Content})
+	}
+	type delta Delta
+	return json.Marshal(delta(d))
+}
+
+// ImageContentPart OpenAI 格式的图片内容块
+type ImageContentPart struct {
+	Type     string   `json:"type"`
+	ImageURL ImageURL `json:"image_url"`
 }
 
-type ChatResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
+// ChatCompletionMessage 非流式回复中的消息。Content 保持字符串（图片为 Markdown 链接），只认字符串的客户端也能使用
+type ChatCompletionMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images 不属于 OpenAI 的 chat.completion 格式，是本服务的扩展字段：只在非流式请求画图模型时出现，
+	// 每项是与请求消息相同的 image_url 内容块，顺序与 Content 中的链接一致。README 中有说明
+	Images []ImageContentPart `json:"images,omitempty"`
+}
+
+type ChatCompletionChoice struct {
+	Index        int                   `json:"index"`
+	Message      ChatCompletionMessage `json:"message"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+// ChatCompletion 非流式的 chat.completion 回复
+type ChatCompletion struct {
+	ID      string                 `json:"id"`
+	Object  string                 `json:"object"`
+	Created int64                  `json:"created"`
+	Model   string                 `json:"model"`
+	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   Usage                  `json:"usage"`
+}
+
+// newChatCompletion 返回只有一个选项的 chat.completion 回复
+func newChatCompletion(model string, message ChatCompletionMessage, usage Usage) ChatCompletion {
+	return ChatCompletion{
+		ID:      "chatcmpl-" + generateUUID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   model,
+		Choices: []ChatCompletionChoice{{Index: 0, Message: message, FinishReason: "stop"}},
+		Usage:   usage,
+	}
 }
 
 type MerlinRequest struct {
@@ -149,11 +187,6 @@ type MerlinImageRequest struct {
 	} `json:"settings"`
 }
 
-type ImageGenerationResult struct {
-	Response ImageGenerationResponse
-	Err      error
-}
-
 type MerlinImageGenerationRequest struct {
 	Action struct {
 		Message struct {
@@ -199,29 +232,43 @@ type OpenAIErrorResponse struct {
 }
 
 type OpenAIStreamResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	Usage   *Usage        `json:"usage,omitempty"`
 }
 
 // OpenAI 图片生成请求结构
 type OpenAIImageGenerationRequest struct {
-	Prompt string `json:"prompt"`
-	N      int    `json:"n,omitempty"`
-	Size   string `json:"size,omitempty"`
-	Model  string `json:"model,omitempty"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	Model          string `json:"model,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	Style          string `json:"style,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	// 以下为扩展字段，对应 Merlin 的生成参数
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Seed           *int   `json:"seed,omitempty"`
+	PromptMagic    bool   `json:"prompt_magic,omitempty"`
 }
 
 // OpenAI 图片生成响应结构
 type OpenAIImageGenerationResponse struct {
-	Created int64 `json:"created"`
-	Data    []struct {
-		URL           string `json:"url"`
-		B64JSON       string `json:"b64_json"`
-		RevisedPrompt string `json:"revised_prompt"`
-	} `json:"data"`
+	Created int64       `json:"created"`
+	Data    []ImageData `json:"data"`
+}
+
+// ImageData 一张生成的图片
+type ImageData struct {
+	URL           string `json:"url,omitempty"`
+	B64JSON       string `json:"b64_json,omitempty"`
+	RevisedPrompt string `json:"revised_prompt,omitempty"`
+	// Seed 和 IID 为扩展字段，用相同的 seed 和参数可以复现图片
+	Seed *int   `json:"seed,omitempty"`
+	IID  string `json:"iid,omitempty"`
 }
 
 type WallflowerRequest struct {
@@ -230,12 +277,16 @@ type WallflowerRequest struct {
 			AspectRatio    string `json:"aspectRatio"`
 			ModelId        string `json:"modelId"`
 			NumberOfImages int    `json:"numberOfImages"`
+			Seed           *int   `json:"seed,omitempty"`
 		} `json:"modelConfig"`
 		Type string `json:"type"`
 	} `json:"feature"`
-	IsPublic bool   `json:"isPublic"`
-	Prompt   string `json:"prompt"`
-	Style    string `json:"style"`
+	Attachments       []merlin.Attachment `json:"attachments,omitempty"`
+	IsPublic          bool                `json:"isPublic"`
+	MerlinPromptMagic bool                `json:"merlinPromptMagic"`
+	NegativePrompt    string              `json:"negativePrompt,omitempty"`
+	Prompt            string              `json:"prompt"`
+	Style             string              `json:"style"`
 }
 
 // 定义通用的URL结构体
@@ -260,161 +311,48 @@ type WallflowerResponse struct {
 	} `json:"payload"`
 }
 
-func getTokenWithCache() (string, error) {
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
-
-	// 如果token还在有效期内,直接返回
-	if tokenCache != "" && time.Now().Before(tokenExpiry) {
-		return tokenCache, nil
-	}
-
-	// 获取新token
-	token, err := auth.GenerateToken()
-	if err != nil {
-		return "", err
+// recordUpstreamError 记录账号的上游错误，服务关闭导致的中断不计入
+func recordUpstreamError(ctx context.Context, accountID string, err error) {
+	if err != nil && accountID != "" && !isCut(ctx) {
+		auth.RecordUpstreamError(accountID, err)
 	}
-
-	// 更新缓存
-	tokenCache = token
-	tokenExpiry = time.Now().Add(30 * time.Minute)
-
-	return token, nil
-}
-
-func getCachedImageResult(prompt string) (ImageGenerationResult, bool) {
-	requestCacheMux.RLock()
-	defer requestCacheMux.RUnlock()
-
-	result, exists := requestCache[prompt]
-	return result, exists
-}
-
-func cacheImageResult(prompt string, result ImageGenerationResult) {
-	requestCacheMux.Lock()
-	defer requestCacheMux.Unlock()
-
-	requestCache[prompt] = result
 }
 
 func generateUUID() string {
 	return uuid.New().String()
 }
 
-func generateImage(w http.ResponseWriter, flusher http.Flusher, prompt string, model string) {
-	log.Printf("开始生成图片，提示词: %s, 模型: %s", prompt, model)
-
-	// 设置响应头
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("x-request-id", generateUUID())
-	log.Printf("响应头设置完成")
-
-	// 创建带超时的HTTP客户端
-	client := &http.Client{
-		Timeout: 60 * time.Second, // 增加超时时间到60秒
-		Transport: &http.Transport{
-			TLSHandshakeTimeout: 10 * time.Second,
-			IdleConnTimeout:     90 * time.Second,
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 100,
-		},
-	}
-
-	// 获取 session token
-	sessionToken := os.Getenv("MERLIN_SESSION_TOKEN")
-	if sessionToken == "" {
-		log.Printf("错误: MERLIN_SESSION_TOKEN 未设置")
-		sendErrorResponse(w, "MERLIN_SESSION_TOKEN is not set", "internal_error", http.StatusInternalServerError)
-		return
-	}
-	log.Printf("成功获取 session token")
-
-	// 构建 session 请求
-	sessionReq, err := http.NewRequest("GET", "https://session.getmerlin.in/?from=web", nil)
-	if err != nil {
-		log.Printf("错误: 创建session请求失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("create session request failed: %v", err), "internal_error", http.StatusInternalServerError)
-		return
-	}
-	log.Printf("session请求创建成功")
-
-	// 设置 session 请求头
-	sessionReq.Header.Set("accept", "application/json, text/plain, */*")
-	sessionReq.Header.Set("accept-language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	sessionReq.Header.Set("cache-control", "no-cache")
-	sessionReq.Header.Set("origin", "https://www.getmerlin.in")
-	sessionReq.Header.Set("pragma", "no-cache")
-	sessionReq.Header.Set("referer", "https://www.getmerlin.in/")
-	sessionReq.Header.Set("sec-ch-ua", `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`)
-	sessionReq.Header.Set("sec-ch-ua-mobile", "?0")
-	sessionReq.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	sessionReq.Header.Set("sec-fetch-dest", "empty")
-	sessionReq.Header.Set("sec-fetch-mode", "cors")
-	sessionReq.Header.Set("sec-fetch-site", "same-site")
-	sessionReq.Header.Set("cookie", fmt.Sprintf("__Secure-authjs.session-token=%s", sessionToken))
-	log.Printf("session请求头设置完成")
-
-	// 发送 session 请求
-	log.Printf("正在发送session请求...")
-	sessionResp, err := client.Do(sessionReq)
-	if err != nil {
-		log.Printf("错误: session请求失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("session request failed: %v", err), "internal_error", http.StatusInternalServerError)
-		return
-	}
-	defer sessionResp.Body.Close()
-	log.Printf("session请求发送成功，状态码: %d", sessionResp.StatusCode)
-
-	if sessionResp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(sessionResp.Body)
-		log.Printf("错误: session请求返回非200状态码: %d, 响应体: %s", sessionResp.StatusCode, string(body))
-		sendErrorResponse(w, fmt.Sprintf("session request returned non-200 status code: %d", sessionResp.StatusCode), "internal_error", sessionResp.StatusCode)
-		return
-	}
-
-	sessionBody, err := io.ReadAll(sessionResp.Body)
-	if err != nil {
-		log.Printf("错误: 读取session响应失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("read session response failed: %v", err), "internal_error", http.StatusInternalServerError)
-		return
-	}
-	log.Printf("session响应读取成功: %s", string(sessionBody))
-
-	var sessionData struct {
-		User struct {
-			AccessToken string `json:"accessToken"`
-		} `json:"user"`
-	}
-	if err = json.Unmarshal(sessionBody, &sessionData); err != nil {
-		log.Printf("错误: 解析session响应失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("decode session response failed: %v, response: %s", err, string(sessionBody)), "internal_error", http.StatusInternalServerError)
-		return
+// generateImages 请求 Merlin 生成图片，返回生成的全部图片。onEvent 不为 nil 时，每收到一个进度或图片事件就调用一次，
+// 返回错误时停止生成
+func generateImages(ctx context.Context, prompt string, opts imageOptions, onEvent func(merlin.Event) error) (images []merlin.Variation, err error) {
+	if cached, ok := cachedImages(prompt, opts); ok {
+		log.Printf("命中图片缓存，提示词: %s, 模型: %s", prompt, opts.Model)
+		if onEvent != nil {
+			if err := onEvent(merlin.ImagesEvent{Variations: cached}); err != nil {
+				return nil, err
+			}
+		}
+		return cached, nil
 	}
 
-	if sessionData.User.AccessToken == "" {
-		log.Printf("错误: 收到空的access token")
-		sendErrorResponse(w, fmt.Sprintf("received empty access token, response: %s", string(sessionBody)), "internal_error", http.StatusInternalServerError)
-		return
-	}
-	log.Printf("成功获取access token")
+	model := opts.Model
+	log.Printf("开始生成图片，类型: %s, 提示词: %s, 模型: %s, 数量: %d, 宽高比: %s", opts.featureType(), prompt, model, opts.N, opts.AspectRatio)
+	var upstreamErr error
+	var account auth.Account
+	ctx, span := tracing.Start(ctx, "merlin.wallflower.generate",
+		tracing.AttrModel.String(model))
+	defer func() {
+		result := "success"
+		if err != nil {
+			result = "error"
+		}
+		metrics.ImageGenerationsTotal.WithLabelValues(metrics.ModelLabel(model), result).Inc()
+		recordUpstreamError(ctx, account.ID, upstreamErr)
+		tracing.End(span, err)
+	}()
 
 	// 根据模型名称选择对应的ModelId
-	var modelId string
-	switch model {
-	case "recraft-v3":
-		modelId = "fal-ai/recraft-v3"
-	case "flux-1.1-pro":
-		modelId = "black-forest-labs/flux-1.1-pro"
-	default:
-		// 如果没有指定模型，使用用户传入的模型名称
-		modelId = model
-	}
-
+	modelId := opts.modelID()
 	log.Printf("使用模型: %s", modelId)
 
 	// 构造新的 Wallflower 请求
@@ -424,6 +362,7 @@ func generateImage(w http.ResponseWriter, flusher http.Flusher, prompt string, m
 				AspectRatio    string `json:"aspectRatio"`
 				ModelId        string `json:"modelId"`
 				NumberOfImages int    `json:"numberOfImages"`
+				Seed           *int   `json:"seed,omitempty"`
 			} `json:"modelConfig"`
 			Type string `json:"type"`
 		}{
@@ -431,214 +370,216 @@ func generateImage(w http.ResponseWriter, flusher http.Flusher, prompt string, m
 				AspectRatio    string `json:"aspectRatio"`
 				ModelId        string `json:"modelId"`
 				NumberOfImages int    `json:"numberOfImages"`
+				Seed           *int   `json:"seed,omitempty"`
 			}{
-				AspectRatio:    "1:1",
+				AspectRatio:    opts.AspectRatio,
 				ModelId:        modelId,
-				NumberOfImages: 2,
+				NumberOfImages: opts.N,
+				Seed:           opts.Seed,
 			},
-			Type: "GENERATE",
+			Type: opts.featureType(),
 		},
-		IsPublic: false,
-		Prompt:   prompt,
-		Style:    "Auto",
+		Attachments:       opts.Attachments,
+		IsPublic:          false,
+		MerlinPromptMagic: opts.PromptMagic,
+		NegativePrompt:    opts.NegativePrompt,
+		Prompt:            prompt,
+		Style:             opts.merlinStyle(),
 	}
 	log.Printf("Wallflower请求体构造完成: %+v", reqBody)
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
-		log.Printf("错误: 序列化请求体失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("error marshaling request body: %v", err), "internal_error", http.StatusInternalServerError)
-		return
+		return nil, fmt.Errorf("error marshaling request body: %v", err)
 	}
 	log.Printf("请求体序列化成功: %s", string(jsonData))
 
-	httpReq, err := http.NewRequest("POST", "https://arcane.getmerlin.in/v1/wallflower/unified-generation", bytes.NewReader(jsonData))
-	if err != nil {
-		log.Printf("错误: 创建HTTP请求失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("error creating request: %v", err), "internal_error", http.StatusInternalServerError)
-		return
-	}
-	log.Printf("HTTP请求创建成功")
-
-	// 设置请求头
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Accept", "text/event-stream")
-	httpReq.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	httpReq.Header.Set("Cache-Control", "no-cache")
-	httpReq.Header.Set("Origin", "https://www.getmerlin.in")
-	httpReq.Header.Set("Pragma", "no-cache")
-	httpReq.Header.Set("Priority", "u=1, i")
-	httpReq.Header.Set("Referer", "https://www.getmerlin.in/")
-	httpReq.Header.Set("Sec-Ch-Ua", `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`)
-	httpReq.Header.Set("Sec-Ch-Ua-Mobile", "?0")
-	httpReq.Header.Set("Sec-Ch-Ua-Platform", `"macOS"`)
-	httpReq.Header.Set("Sec-Fetch-Dest", "empty")
-	httpReq.Header.Set("Sec-Fetch-Mode", "cors")
-	httpReq.Header.Set("Sec-Fetch-Site", "same-site")
-	httpReq.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sessionData.User.AccessToken))
-	httpReq.Header.Set("x-merlin-version", "web-merlin")
-	log.Printf("HTTP请求头设置完成")
-
 	log.Printf("正在发送图片生成请求...")
-	resp, err := client.Do(httpReq)
+	resp, account, err := doUpstream(ctx, func(ctx context.Context, account auth.Account, accessToken string) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", upstream.ArcaneURL()+"/v1/wallflower/unified-generation", bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		// 设置请求头
+		profile.ForAccount(account.ID).Apply(httpReq.Header)
+		httpReq.Header.Set("Content-Type", "application/json")
+		httpReq.Header.Set("Accept", "text/event-stream")
+		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		return httpReq, nil
+	})
 	if err != nil {
-		log.Printf("错误: 发送请求失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("send request failed: %v", err), "internal_error", http.StatusInternalServerError)
-		return
+		log.Printf("错误: 图片生成请求失败: %v", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
-	log.Printf("请求发送成功，状态码: %d", resp.StatusCode)
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		log.Printf("错误: 服务器返回非200状态码: %d, 响应体: %s", resp.StatusCode, string(body))
-		sendErrorResponse(w, fmt.Sprintf("server returned non-200 status code: %d, body: %s", resp.StatusCode, string(body)), "internal_error", resp.StatusCode)
-		return
-	}
+	span.SetAttributes(tracing.AttrAccount.String(account.ID))
+	log.Printf("请求发送成功，账号: %s", account.ID)
 
 	log.Printf("开始处理响应流...")
-	scanner := bufio.NewScanner(resp.Body)
-	var allImageURLs []string
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("收到响应行: %s", line)
-
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		data := strings.TrimPrefix(line, "data: ")
-		if data == "[DONE]" {
-			break
-		}
-
-		var event struct {
-			Status  string `json:"status"`
-			Payload []struct {
-				Variations []struct {
-					URL  string `json:"url"`
-					IID  string `json:"iid"`
-					Seed int    `json:"seed"`
-				} `json:"variations"`
-			} `json:"payload"`
-		}
-
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			log.Printf("解析事件失败: %v, data: %s", err, data)
-			continue
-		}
-
-		// 收集所有图片URL
-		for _, payload := range event.Payload {
-			for _, variation := range payload.Variations {
-				if variation.URL != "" {
-					allImageURLs = append(allImageURLs, variation.URL)
-					log.Printf("找到图片URL: %s", variation.URL)
+	_, translateSpan := tracing.Start(ctx, "sse.translate")
+	defer translateSpan.End()
+
+	decoder := merlin.NewDecoder(resp.Body)
+
+stream:
+	for decoder.Next() {
+		switch event := decoder.Event().(type) {
+		case merlin.ProgressEvent:
+			log.Printf("图片生成进度: %s %.0f", event.Status, event.Percent)
+			if onEvent != nil {
+				if err := onEvent(event); err != nil {
+					return nil, err
 				}
 			}
+		case merlin.ImagesEvent:
+			// 收集所有图片
+			for _, variation := range event.Variations {
+				images = append(images, variation)
+				log.Printf("找到图片URL: %s", variation.URL)
+			}
+			if onEvent != nil {
+				if err := onEvent(event); err != nil {
+					return nil, err
+				}
+			}
+		case merlin.ErrorEvent:
+			log.Printf("错误: 上游返回错误事件: %v", event)
+			upstreamErr = event
+			return nil, event
+		case merlin.DoneEvent:
+			break stream
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
+	if err := decoder.Err(); err != nil {
 		log.Printf("错误: 读取响应流失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("error reading response stream: %v", err), "internal_error", http.StatusInternalServerError)
-		return
+		upstreamErr = err
+		return nil, fmt.Errorf("read response failed: %w", err)
 	}
 
-	if len(allImageURLs) == 0 {
+	if len(images) == 0 {
 		log.Printf("错误: 未找到有效的图片URL")
-		sendErrorResponse(w, "no valid image URLs found", "internal_error", http.StatusInternalServerError)
-		return
+		return nil, errNoImages
+	}
+	if len(images) < opts.N {
+		log.Printf("Warning: requested %d images, Merlin returned %d", opts.N, len(images))
 	}
 
-	log.Printf("成功获取图片URL: %v", allImageURLs)
+	log.Printf("成功获取 %d 张图片", len(images))
+	metrics.ImagesGeneratedTotal.WithLabelValues(metrics.ModelLabel(model)).Add(float64(len(images)))
+	storeImages(prompt, opts, images)
+	return images, nil
+}
 
-	// 构建OpenAI流式响应
-	streamResp := OpenAIStreamResponse{
-		ID:      generateUUID(),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   "dall-e-3",
-		Choices: []Choice{
-			{
-				Delta: Delta{
-					Content: fmt.Sprintf("生成的图片:\n1. ![image](%s)\n2. ![image](%s)", allImageURLs[0], allImageURLs[1]),
-					Role:    "assistant",
-				},
-				Index: 0,
-			},
-		},
+// generateImage 生成图片并以聊天流的形式返回，用于通过聊天接口调用画图模型。生成过程中把进度作为文字发送，
+// 每张图片到达后立即以 Markdown 图片链接发送
+func generateImage(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, prompt string, opts imageOptions) {
+	// 设置响应头
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("x-request-id", generateUUID())
+
+	// 等待上游期间定期发送心跳；心跳或第一个块发出后，之后的错误只能以事件形式返回
+	heartbeat := startHeartbeat(w, flusher, heartbeatIntervalFromEnv())
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
+
+	chunks := newChunkWriter(w, flusher, opts.Model)
+	started := false
+	progress := newImageProgress(opts.N)
+	emit := func(text string) error {
+		metrics.ObserveFirstToken(ctx)
+		if !started {
+			started = true
+			return chunks.write(Delta{Role: "assistant", Content: text}, nil)
+		}
+		return chunks.content(text)
 	}
 
-	respBytes, err := json.Marshal(streamResp)
+	_, err := generateImages(ctx, prompt, opts, func(event merlin.Event) error {
+		switch event := event.(type) {
+		case merlin.ProgressEvent:
+			if text := progress.status(event); text != "" {
+				return emit(text)
+			}
+		case merlin.ImagesEvent:
+			// 保存图片后再发送，配置了图片存储时链接为本服务的地址
+			data, err := imageData(ctx, prompt, opts, event.Variations, "url")
+			if err != nil {
+				return err
+			}
+			for _, image := range data {
+				if err := emit(progress.image(image.URL)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Printf("错误: 序列化响应失败: %v", err)
-		sendErrorResponse(w, fmt.Sprintf("marshal response failed: %v", err), "internal_error", http.StatusInternalServerError)
+		log.Printf("错误: 图片生成失败: %v", err)
+		// 先停止心跳再判断是否已经写出数据，否则判断之后发出的心跳会和 JSON 错误混在一起
+		heartbeat.Stop()
+		respondError(ctx, w, flusher, err, started || heartbeat.Started())
 		return
 	}
 
-	// 发送数据
-	fmt.Fprintf(w, "data: %s\n\n", string(respBytes))
-	flusher.Flush()
-
-	// 发送结束标记
-	fmt.Fprintf(w, "data: [DONE]\n\n")
-	flusher.Flush()
+	// 发送结束块和结束标记
+	chunks.finish("stop", nil)
 	log.Printf("响应发送完成")
 }
 
-func processCompletedEvent(event struct {
-	Status string `json:"status"`
-	Data   struct {
-		Content   string `json:"content"`
-		EventType string `json:"eventType"`
-		Error     string `json:"error,omitempty"`
-	} `json:"data"`
-}) ([]struct {
-	URL     string `json:"url"`
-	B64JSON string `json:"b64_json,omitempty"`
-}, error) {
-	var imageURLs []struct {
-		URL     string `json:"url"`
-		B64JSON string `json:"b64_json,omitempty"`
+// generateImageCompletion 生成图片并以非流式的 chat.completion 返回，消息内容为 Markdown 图片链接，
+// 同时在 images 中以图片内容块返回
+func generateImageCompletion(ctx context.Context, w http.ResponseWriter, prompt string, opts imageOptions) {
+	images, err := generateImages(ctx, prompt, opts, nil)
+	if err == nil {
+		var data []ImageData
+		data, err = imageData(ctx, prompt, opts, images, "url")
+		if err == nil {
+			err = handleImageCompletion(w, prompt, opts.Model, data)
+		}
 	}
-
-	if event.Data.Content == "" {
-		return nil, fmt.Errorf("空content响应")
+	if err != nil {
+		log.Printf("错误: 图片生成失败: %v", err)
+		respondError(ctx, w, nil, err, false)
 	}
-
-	imageURLs = append(imageURLs, struct {
-		URL     string `json:"url"`
-		B64JSON string `json:"b64_json,omitempty"`
-	}{
-		URL:     event.Data.Content,
-		B64JSON: "",
-	})
-
-	return imageURLs, nil
 }
 
-func handleImageResponse(w http.ResponseWriter, urls []string) error {
-	if len(urls) == 0 {
-		log.Printf("No URLs provided to handleImageResponse")
-		return fmt.Errorf("no image URLs available")
+// handleImageCompletion 把生成的图片写成 chat.completion 回复
+func handleImageCompletion(w http.ResponseWriter, prompt string, model string, images []ImageData) error {
+	urls := make([]string, 0, len(images))
+	parts := make([]ImageContentPart, 0, len(images))
+	for _, image := range images {
+		urls = append(urls, image.URL)
+		parts = append(parts, ImageContentPart{Type: "image_url", ImageURL: ImageURL{URL: image.URL}})
 	}
+	content := imageMarkdown(urls)
 
-	log.Printf("Handling image response with URL: %s", urls[0])
+	response := newChatCompletion(model,
+		ChatCompletionMessage{Role: "assistant", Content: content, Images: parts},
+		estimateUsage(model, prompt, content))
 
-	// 构造标准的 OpenAI 图片响应格式
-	response := struct {
-		Created int64 `json:"created"`
-		Data    []struct {
-			URL string `json:"url"`
-		} `json:"data"`
-	}{
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("x-request-id", generateUUID())
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return fmt.Errorf("failed to encode response: %v", err)
+	}
+	log.Printf("Successfully sent chat completion with %d images", len(images))
+	return nil
+}
+
+// handleImageResponse 以 OpenAI 图片接口的 JSON 格式返回生成的图片
+func handleImageResponse(w http.ResponseWriter, model string, images []ImageData) error {
+	response := OpenAIImageGenerationResponse{
 		Created: time.Now().Unix(),
-		Data: []struct {
-			URL string `json:"url"`
-		}{{URL: urls[0]}},
+		Data:    images,
 	}
 
 	// 设置标准的 OpenAI 响应头
@@ -648,7 +589,7 @@ func handleImageResponse(w http.ResponseWriter, urls []string) error {
 	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	w.Header().Set("x-request-id", generateUUID())
-	w.Header().Set("openai-model", "dall-e-3")
+	w.Header().Set("openai-model", model)
 	w.Header().Set("openai-organization", "org-default")
 	w.Header().Set("openai-processing-ms", "3547")
 	w.Header().Set("openai-version", "2020-10-01")
@@ -661,7 +602,7 @@ func handleImageResponse(w http.ResponseWriter, urls []string) error {
 		return fmt.Errorf("failed to encode response: %v", err)
 	}
 
-	log.Printf("Successfully sent image response with URL: %s", urls[0])
+	log.Printf("Successfully sent image response with %d images", len(images))
 	return nil
 }
 
@@ -675,50 +616,91 @@ func writeStreamResponse(w http.ResponseWriter, flusher http.Flusher, content st
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	w.Header().Set("x-request-id", generateUUID())
 
-	response := OpenAIStreamResponse{
-		ID:      "chatcmpl-" + generateUUID(),
-		Object:  "chat.completion.chunk",
-		Created: time.Now().Unix(),
-		Model:   "gpt-4",
-		Choices: []Choice{
-			{
-				Delta: struct {
-					Content string `json:"content,omitempty"`
-					Role    string `json:"role,omitempty"`
-				}{
-					Content: content,
-					Role:    "assistant",
-				},
-				Index:        0,
-				FinishReason: "",
-			},
-		},
+	chunks := newChunkWriter(w, flusher, "gpt-4")
+	if err := chunks.write(Delta{Content: content, Role: "assistant"}, nil); err != nil {
+		return err
 	}
-
 	if isLast {
-		response.Choices[0].FinishReason = "stop"
+		return chunks.finish("stop", nil)
 	}
+	return nil
+}
+
+// writeStreamError 在流已经开始后以 SSE 事件的形式发送 OpenAI 错误
+func writeStreamError(w http.ResponseWriter, flusher http.Flusher, message string, errorType string, code string) {
+	var errorResponse OpenAIErrorResponse
+	errorResponse.Error.Message = message
+	errorResponse.Error.Type = errorType
+	errorResponse.Error.Code = code
 
-	data, err := json.Marshal(response)
+	data, err := json.Marshal(errorResponse)
 	if err != nil {
-		return err
+		return
 	}
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+}
 
-	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
-		return err
+// openThread 发送 thread/unified 请求，失败时按重试策略重试并切换账号
+func openThread(ctx context.Context, merlinReq MerlinRequest) (*http.Response, auth.Account, error) {
+	merlinReqBody, err := json.Marshal(merlinReq)
+	if err != nil {
+		return nil, auth.Account{}, fmt.Errorf("marshal request body failed: %v", err)
 	}
 
-	if isLast {
-		if _, err := fmt.Fprintf(w, "data: [DONE]\n\n"); err != nil {
-			return err
+	log.Printf("Sending request to Merlin: %s", string(merlinReqBody))
+
+	return doUpstream(ctx, func(ctx context.Context, account auth.Account, accessToken string) (*http.Request, error) {
+		chatReq, err := http.NewRequestWithContext(ctx, "POST", upstream.ArcaneURL()+"/v1/thread/unified", bytes.NewReader(merlinReqBody))
+		if err != nil {
+			return nil, fmt.Errorf("create chat request failed: %v", err)
+		}
+
+		// 设置聊天请求头
+		profile.ForAccount(account.ID).Apply(chatReq.Header)
+		chatReq.Header.Set("Content-Type", "application/json")
+		chatReq.Header.Set("Accept", "text/event-stream")
+		chatReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		return chatReq, nil
+	})
+}
+
+// translateThread 把上游事件中的文本交给 emit，done 表示收到了上游的结束事件
+func translateThread(body io.Reader, emit func(text string) error) (done bool, err error) {
+	decoder := merlin.NewDecoder(body)
+	for decoder.Next() {
+		switch event := decoder.Event().(type) {
+		case merlin.ContentEvent:
+			if err := emit(event.Text); err != nil {
+				return false, err
+			}
+		case merlin.ErrorEvent:
+			return false, event
+		case merlin.DoneEvent:
+			return true, nil
 		}
 	}
 
-	flusher.Flush()
-	return nil
+	if err := decoder.Err(); err != nil {
+		return false, fmt.Errorf("read response failed: %w", err)
+	}
+	return false, nil
 }
 
-func streamFromMerlin(merlinReq MerlinRequest, w http.ResponseWriter, flusher http.Flusher) (string, error) {
+// errStreamTruncated 上游在发送结束事件之前关闭了流
+var errStreamTruncated = errors.New("upstream closed the stream before it finished")
+
+// streamFromMerlin 把上游回复转换为 OpenAI 流式响应。started 表示是否已经向客户端写出数据，
+// 未开始时调用方可以返回带状态码的 JSON 错误
+func streamFromMerlin(ctx context.Context, merlinReq MerlinRequest, w http.ResponseWriter, flusher http.Flusher, includeUsage bool) (started bool, err error) {
+	var account auth.Account
+	ctx, span := tracing.Start(ctx, "merlin.thread.unified",
+		tracing.AttrModel.String(merlinReq.Model))
+	defer func() {
+		recordUpstreamError(ctx, account.ID, err)
+		tracing.End(span, err)
+	}()
+
 	// 设置响应头
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
@@ -728,296 +710,141 @@ func streamFromMerlin(merlinReq MerlinRequest, w http.ResponseWriter, flusher ht
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 	w.Header().Set("x-request-id", generateUUID())
 
-	// 获取 session token
-	sessionToken := os.Getenv("MERLIN_SESSION_TOKEN")
-	if sessionToken == "" {
-		return "", fmt.Errorf("MERLIN_SESSION_TOKEN is not set")
-	}
+	// 等待上游期间定期发送心跳；心跳发出后响应头已经写出，之后的错误只能以事件形式返回
+	heartbeat := startHeartbeat(w, flusher, heartbeatIntervalFromEnv())
+	defer heartbeat.Stop()
+	w, flusher = heartbeat, heartbeat
 
-	// 构建 session 请求
-	sessionReq, err := http.NewRequest("GET", "https://session.getmerlin.in/?from=web", nil)
-	if err != nil {
-		return "", fmt.Errorf("create session request failed: %v", err)
-	}
-
-	// 设置请求头
-	sessionReq.Header.Set("accept", "application/json, text/plain, */*")
-	sessionReq.Header.Set("accept-language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	sessionReq.Header.Set("cache-control", "no-cache")
-	sessionReq.Header.Set("origin", "https://www.getmerlin.in")
-	sessionReq.Header.Set("pragma", "no-cache")
-	sessionReq.Header.Set("referer", "https://www.getmerlin.in/")
-	sessionReq.Header.Set("sec-ch-ua", `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`)
-	sessionReq.Header.Set("sec-ch-ua-mobile", "?0")
-	sessionReq.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	sessionReq.Header.Set("sec-fetch-dest", "empty")
-	sessionReq.Header.Set("sec-fetch-mode", "cors")
-	sessionReq.Header.Set("sec-fetch-site", "same-site")
-	sessionReq.Header.Set("cookie", fmt.Sprintf("__Secure-authjs.session-token=%s", sessionToken))
-
-	log.Printf("Sending request to get session token...")
-	client := &http.Client{}
-	sessionResp, err := client.Do(sessionReq)
+	resp, account, err := openThread(ctx, merlinReq)
 	if err != nil {
-		return "", fmt.Errorf("session request failed: %v", err)
+		// 先停止心跳再判断是否已经写出数据，调用方据此决定返回 JSON 还是错误事件
+		heartbeat.Stop()
+		return heartbeat.Started(), err
 	}
-	defer sessionResp.Body.Close()
+	span.SetAttributes(tracing.AttrAccount.String(account.ID))
+	log.Printf("Merlin response status: %s, account: %s", resp.Status, account.ID)
 
-	body, err := io.ReadAll(sessionResp.Body)
-	if err != nil {
-		return "", fmt.Errorf("read session response failed: %v", err)
+	// 发送初始消息，之后的块共用同一个 id
+	chunks := newChunkWriter(w, flusher, merlinReq.Model)
+	chunks.includeUsage = includeUsage
+	if err := chunks.role(); err != nil {
+		return true, err
 	}
-	log.Printf("Session response: %s", string(body))
 
-	var sessionData struct {
-		User struct {
-			AccessToken string `json:"accessToken"`
-		} `json:"user"`
-	}
-	if err := json.Unmarshal(body, &sessionData); err != nil {
-		return "", fmt.Errorf("decode session response failed: %v, response: %s", err, string(body))
-	}
+	_, translateSpan := tracing.Start(ctx, "sse.translate")
+	defer translateSpan.End()
 
-	if sessionData.User.AccessToken == "" {
-		return "", fmt.Errorf("received empty access token, response: %s", string(body))
+	var answer strings.Builder
+	emit := func(text string) error {
+		metrics.ObserveFirstToken(ctx)
+		if err := chunks.content(text); err != nil {
+			return err
+		}
+		answer.WriteString(text)
+		return nil
 	}
 
-	token := sessionData.User.AccessToken
-	log.Printf("Successfully got access token")
+	done, err := translateThread(resp.Body, emit)
+	resp.Body.Close()
 
-	// 发送聊天请求
-	merlinReqBody, err := json.Marshal(merlinReq)
-	if err != nil {
-		return "", fmt.Errorf("marshal request body failed: %v", err)
-	}
+	// 续写模式：流在回答中途断开时，让上游从断点继续生成并拼接到已发送的内容之后
+	policy := continuePolicyFromEnv()
+	for attempt := 1; !done && policy.shouldContinue(ctx, attempt, answer.String(), err); attempt++ {
+		log.Printf("Stream broke after %d bytes (%v), continuing (attempt %d)", answer.Len(), err, attempt)
+		recordUpstreamError(ctx, account.ID, err)
 
-	log.Printf("Sending request to Merlin: %s", string(merlinReqBody))
-
-	chatReq, err := http.NewRequest("POST", "https://arcane.getmerlin.in/v1/thread/unified", strings.NewReader(string(merlinReqBody)))
-	if err != nil {
-		return "", fmt.Errorf("create chat request failed: %v", err)
-	}
-
-	// 设置聊天请求头
-	chatReq.Header.Set("Content-Type", "application/json")
-	chatReq.Header.Set("Accept", "text/event-stream")
-	chatReq.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	chatReq.Header.Set("Origin", "https://www.getmerlin.in")
-	chatReq.Header.Set("Referer", "https://www.getmerlin.in/")
-	chatReq.Header.Set("x-merlin-version", "web-merlin")
-	chatReq.Header.Set("priority", "u=1, i")
-	chatReq.Header.Set("cache-control", "no-cache")
-	chatReq.Header.Set("pragma", "no-cache")
-	chatReq.Header.Set("sec-ch-ua", `"Not_A Brand";v="8", "Chromium";v="120", "Google Chrome";v="120"`)
-	chatReq.Header.Set("sec-ch-ua-mobile", "?0")
-	chatReq.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	chatReq.Header.Set("Sec-Fetch-Dest", "empty")
-	chatReq.Header.Set("Sec-Fetch-Mode", "cors")
-	chatReq.Header.Set("Sec-Fetch-Site", "same-site")
-	chatReq.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-	chatReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	log.Printf("Final Request Headers:")
-	for name, values := range chatReq.Header {
-		if len(values) > 0 {
-			log.Printf("%s: %s", name, values[0])
+		resp, account, err = openThread(ctx, continueRequest(merlinReq, answer.String()))
+		if err != nil {
+			break
+		}
+		splice := newSplicer(answer.String(), emit)
+		done, err = translateThread(resp.Body, splice.write)
+		resp.Body.Close()
+		if flushErr := splice.flush(); err == nil {
+			err = flushErr
 		}
 	}
-
-	resp, err := client.Do(chatReq)
+	usage := chatUsage(merlinReq, answer.String())
+	if err == nil && !done {
+		// 上游没有发送结束事件就关闭了流，回答可能不完整，以错误事件结束而不是假装正常结束
+		err = errStreamTruncated
+	}
 	if err != nil {
-		return "", fmt.Errorf("chat request failed: %v", err)
+		heartbeat.Stop()
+		return heartbeat.Started(), err
 	}
-	defer resp.Body.Close()
-
-	log.Printf("Merlin response status: %s", resp.Status)
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("Received line: %s", line)
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		data := strings.TrimPrefix(line, "data: ")
-		var event struct {
-			Status string `json:"status"`
-			Data   struct {
-				Content     string `json:"content"`
-				EventType   string `json:"eventType"`
-				Attachments []struct {
-					Type string `json:"type"`
-					URL  string `json:"url"`
-				} `json:"attachments"`
-			} `json:"data"`
-		}
-
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			log.Printf("Error parsing event: %v, data: %s", err, data)
-			continue
-		}
-
-		// 只处理实际的内容消息
-		if event.Data.Content != "" && event.Status != "system" {
-			response := OpenAIStreamResponse{
-				ID:      "chatcmpl-" + generateUUID(),
-				Object:  "chat.completion.chunk",
-				Created: time.Now().Unix(),
-				Model:   merlinReq.Model,
-				Choices: []Choice{
-					{
-						Delta: struct {
-							Content string `json:"content,omitempty"`
-							Role    string `json:"role,omitempty"`
-						}{
-							Content: event.Data.Content,
-						},
-						Index: 0,
-					},
-				},
-			}
-
-			data, err := json.Marshal(response)
-			if err != nil {
-				continue
-			}
-
-			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
-				return "", err
-			}
-			flusher.Flush()
-		}
-
-		// 检查是否为完成事件
-		if event.Status == "system" && event.Data.EventType == "DONE" {
-			// 发送最后的 [DONE] 消息
-			if _, err := fmt.Fprintf(w, "data: [DONE]\n\n"); err != nil {
-				return "", err
-			}
-			flusher.Flush()
-			break
-		}
+	// 发送带 finish_reason 的最后一块、按需发送用量块，然后发送 [DONE]
+	var reported *Usage
+	if includeUsage {
+		reported = &usage
 	}
-
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("read response failed: %v", err)
+	if err := chunks.finish("stop", reported); err != nil {
+		return true, err
 	}
-
-	return "", nil
+	return true, nil
 }
 
-func sendToMerlin(merlinReq MerlinRequest) (string, error) {
-	var err error
-
-	// 获取 token
-	token, err := getTokenWithCache()
-	if err != nil {
-		return "", fmt.Errorf("error getting token: %v", err)
-	}
+func sendToMerlin(ctx context.Context, merlinReq MerlinRequest) (content string, err error) {
+	var account auth.Account
+	ctx, span := tracing.Start(ctx, "merlin.thread.unified",
+		tracing.AttrModel.String(merlinReq.Model))
+	defer func() {
+		recordUpstreamError(ctx, account.ID, err)
+		tracing.End(span, err)
+	}()
 
 	// 发送聊天请求
 	merlinReq.Language = "CHINESE_SIMPLIFIED"
 	merlinReq.Mode = "UNIFIED_CHAT"
 	merlinReq.Metadata.WebAccess = true
 
-	merlinReqBody, err := json.Marshal(merlinReq)
-	if err != nil {
-		return "", fmt.Errorf("marshal request body failed: %v", err)
-	}
-
-	log.Printf("Sending request to Merlin: %s", string(merlinReqBody))
-
-	chatReq, err := http.NewRequest("POST", "https://arcane.getmerlin.in/v1/thread/unified", strings.NewReader(string(merlinReqBody)))
+	resp, account, err := openThread(ctx, merlinReq)
 	if err != nil {
-		return "", fmt.Errorf("create chat request failed: %v", err)
-	}
-
-	// 设置聊天请求头
-	chatReq.Header.Set("Content-Type", "application/json")
-	chatReq.Header.Set("Accept", "text/event-stream")
-	chatReq.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	chatReq.Header.Set("Origin", "https://www.getmerlin.in")
-	chatReq.Header.Set("Referer", "https://www.getmerlin.in/")
-	chatReq.Header.Set("x-merlin-version", "web-merlin")
-	chatReq.Header.Set("priority", "u=1, i")
-	chatReq.Header.Set("cache-control", "no-cache")
-	chatReq.Header.Set("pragma", "no-cache")
-	chatReq.Header.Set("sec-ch-ua", `"Not_A Brand";v="8", "Chromium";v="120", "Google Chrome";v="120"`)
-	chatReq.Header.Set("sec-ch-ua-mobile", "?0")
-	chatReq.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	chatReq.Header.Set("Sec-Fetch-Dest", "empty")
-	chatReq.Header.Set("Sec-Fetch-Mode", "cors")
-	chatReq.Header.Set("Sec-Fetch-Site", "same-site")
-	chatReq.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-	chatReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	log.Printf("Final Request Headers:")
-	for name, values := range chatReq.Header {
-		if len(values) > 0 {
-			log.Printf("%s: %s", name, values[0])
-		}
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(chatReq)
-	if err != nil {
-		return "", fmt.Errorf("chat request failed: %v", err)
+		return "", err
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(tracing.AttrAccount.String(account.ID))
 
-	log.Printf("Merlin response status: %s", resp.Status)
-
-	var imageUrls []string
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		line := scanner.Text()
-		log.Printf("Received line: %s", line)
-		if !strings.HasPrefix(line, "data: ") {
-			continue
-		}
-
-		data := strings.TrimPrefix(line, "data: ")
-		var event struct {
-			Status string `json:"status"`
-			Data   struct {
-				Content   string `json:"content"`
-				EventType string `json:"eventType"`
-				Message   struct {
-					Attachments []struct {
-						Type string `json:"type"`
-						URL  string `json:"url"`
-					} `json:"attachments"`
-				} `json:"message"`
-			} `json:"data"`
-		}
+	log.Printf("Merlin response status: %s, account: %s", resp.Status, account.ID)
 
-		if err := json.Unmarshal([]byte(data), &event); err != nil {
-			log.Printf("Error parsing event: %v, data: %s", err, data)
-			continue
-		}
+	_, translateSpan := tracing.Start(ctx, "sse.translate")
+	defer translateSpan.End()
 
-		// 检查 Data.Message.Attachments
-		for _, attachment := range event.Data.Message.Attachments {
-			if attachment.URL != "" && attachment.Type == "IMAGE" {
-				log.Printf("Found URL in Data.Message.Attachments: %s", attachment.URL)
-				imageUrls = append(imageUrls, attachment.URL)
+	var builder strings.Builder
+	var imageUrls []string
+	decoder := merlin.NewDecoder(resp.Body)
+stream:
+	for decoder.Next() {
+		switch event := decoder.Event().(type) {
+		case merlin.ContentEvent:
+			// 累积文本内容
+			builder.WriteString(event.Text)
+		case merlin.AttachmentEvent:
+			for _, attachment := range event.Attachments {
+				if attachment.URL != "" && attachment.Type == "IMAGE" {
+					log.Printf("Found image attachment: %s", attachment.URL)
+					imageUrls = append(imageUrls, attachment.URL)
+				}
 			}
+		case merlin.ErrorEvent:
+			return "", event
+		case merlin.DoneEvent:
+			break stream
 		}
+	}
 
-		// 检查是否为完成事件
-		if event.Status == "system" && event.Data.EventType == "DONE" {
-			break
-		}
+	if err := decoder.Err(); err != nil {
+		return "", fmt.Errorf("read response failed: %w", err)
 	}
 
-	if err := scanner.Err(); err != nil {
-		return "", fmt.Errorf("read response failed: %v", err)
+	if builder.Len() > 0 {
+		return builder.String(), nil
 	}
 
 	if len(imageUrls) == 0 {
-		log.Printf("No image URLs found in response")
-		return "", fmt.Errorf("no valid image URLs generated")
+		log.Printf("No content or image URLs found in response")
+		return "", fmt.Errorf("no content generated")
 	}
 
 	log.Printf("Found %d image URLs: %v", len(imageUrls), imageUrls)
@@ -1025,26 +852,15 @@ func sendToMerlin(merlinReq MerlinRequest) (string, error) {
 }
 
 func sendErrorResponse(w http.ResponseWriter, message string, errorType string, statusCode int) {
-	// 构造标准的 OpenAI 错误响应
-	errorResponse := struct {
-		Error struct {
-			Message string `json:"message"`
-			Type    string `json:"type"`
-			Param   string `json:"param,omitempty"`
-			Code    string `json:"code,omitempty"`
-		} `json:"error"`
-	}{
-		Error: struct {
-			Message string `json:"message"`
-			Type    string `json:"type"`
-			Param   string `json:"param,omitempty"`
-			Code    string `json:"code,omitempty"`
-		}{
-			Message: message,
-			Type:    errorType,
-			Code:    "error",
-		},
-	}
+	sendOpenAIError(w, apiError{Status: statusCode, Type: errorType, Code: "error", Message: message})
+}
+
+// sendOpenAIError 在流开始前以 JSON 返回 OpenAI 格式的错误
+func sendOpenAIError(w http.ResponseWriter, e apiError) {
+	var errorResponse OpenAIErrorResponse
+	errorResponse.Error.Message = e.Message
+	errorResponse.Error.Type = e.Type
+	errorResponse.Error.Code = e.Code
 
 	// 设置标准的 OpenAI 错误响应头
 	w.Header().Set("Content-Type", "application/json")
@@ -1060,7 +876,7 @@ func sendErrorResponse(w http.ResponseWriter, message string, errorType string,
 	w.Header().Set("x-ratelimit-remaining-requests", "49")
 	w.Header().Set("x-ratelimit-reset-requests", "1714520399")
 
-	w.WriteHeader(statusCode)
+	w.WriteHeader(e.Status)
 	json.NewEncoder(w).Encode(errorResponse)
 }
 
@@ -1078,10 +894,13 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("Received request to path: %s", r.URL.Path)
 
+	// 根路径等同于存活检查，其他未知路径返回 404
+	if r.URL.Path == "/" {
+		HandleHealthz(w, r)
+		return
+	}
 	if !strings.HasSuffix(r.URL.Path, "/chat/completions") {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, `{"status":"GetMerlin2Api Service Running...","message":"MoLoveSze..."}`)
+		sendOpenAIError(w, withMessage(errNotFound, fmt.Sprintf("Invalid URL (%s %s)", r.Method, r.URL.Path)))
 		return
 	}
 
@@ -1097,10 +916,14 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ctx, done := beginFlow(r)
+	defer done()
+
 	// 设置默认模型为 gpt-4o-64k-output
 	if req.Model == "" {
 		req.Model = "gpt-4o-64k-output"
 	}
+	metrics.SetModel(r.Context(), req.Model)
 
 	// 清理历史消息，只保留最后一条
 	if len(req.Messages) > 0 {
@@ -1128,6 +951,13 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 			Size:   "1024x1024",
 			Model:  req.Model,
 		}
+		opts := imageOptions{Model: imageReq.Model, N: imageReq.N, AspectRatio: "1:1", BaseURL: publicBaseURL(r)}
+		applyCacheControl(r, &opts)
+
+		if !req.Stream {
+			generateImageCompletion(ctx, w, imageReq.Prompt, opts)
+			return
+		}
 
 		// 获取 flusher
 		flusher, ok := w.(http.Flusher)
@@ -1136,7 +966,7 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		generateImage(w, flusher, imageReq.Prompt, req.Model)
+		generateImage(ctx, w, flusher, imageReq.Prompt, opts)
 		return
 	}
 
@@ -1187,67 +1017,33 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
 		flusher, ok := w.(http.Flusher)
 		if !ok {
-			http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+			sendOpenAIError(w, withMessage(errInternal, "Streaming unsupported!"))
 			return
 		}
 
-		// 发送初始消息
-		response := OpenAIStreamResponse{
-			ID:      "chatcmpl-" + generateUUID(),
-			Object:  "chat.completion.chunk",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Choices: []Choice{
-				{
-					Delta: struct {
-						Content string `json:"content,omitempty"`
-						Role    string `json:"role,omitempty"`
-					}{
-						Role: "assistant",
-					},
-					Index: 0,
-				},
-			},
-		}
-
-		data, err := json.Marshal(response)
-		if err == nil {
-			fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
-		}
-
-		content, err := streamFromMerlin(merlinReq, w, flusher)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		started, err := streamFromMerlin(ctx, merlinReq, w, flusher, includeUsage)
 		if err != nil {
 			log.Printf("Error streaming from Merlin: %v", err)
+			respondError(ctx, w, flusher, err, started)
 			return
 		}
-		log.Printf("Streaming completed: %s", content)
+		log.Printf("Streaming completed")
 	} else {
-		content, err := sendToMerlin(merlinReq)
+		content, err := sendToMerlin(ctx, merlinReq)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to send request to Merlin: %v", err), http.StatusInternalServerError)
+			log.Printf("Error sending to Merlin: %v", err)
+			respondError(ctx, w, nil, err, false)
 			return
 		}
 
-		response := ChatResponse{
-			ID:      messageID,
-			Object:  "chat.completion",
-			Created: time.Now().Unix(),
-			Model:   req.Model,
-			Choices: []Choice{
-				{
-					Index: 0,
-					Delta: Delta{
-						Content: content,
-					},
-					FinishReason: "stop",
-				},
-			},
-		}
+		response := newChatCompletion(req.Model,
+			ChatCompletionMessage{Role: "assistant", Content: content},
+			chatUsage(merlinReq, content))
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+			sendOpenAIError(w, withMessage(errInternal, fmt.Sprintf("Failed to encode response: %v", err)))
 			return
 		}
 	}
@@ -1255,7 +1051,7 @@ func HandleChat(w http.ResponseWriter, r *http.Request) {
 
 func HandleImageGeneration(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		sendErrorResponse(w, "Method not allowed", "invalid_request_error", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -1268,19 +1064,35 @@ func HandleImageGeneration(w http.ResponseWriter, r *http.Request) {
 	// 解析请求体
 	var req MerlinImageGenerationRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to decode request: %v", err), http.StatusBadRequest)
+		sendOpenAIError(w, withMessage(errInvalidRequest, fmt.Sprintf("Failed to decode request: %v", err)))
 		return
 	}
 
 	// 创建响应写入器
 	flusher, ok := w.(http.Flusher)
 	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		sendOpenAIError(w, withMessage(errInternal, "Streaming unsupported!"))
 		return
 	}
 
+	ctx, done := beginFlow(r)
+	defer done()
+
 	// 生成图片
-	generateImage(w, flusher, req.Action.Message.Content, req.Action.Message.Metadata.Context)
+	opts := imageOptions{Model: req.Action.Message.Metadata.Context, N: 1, AspectRatio: "1:1", BaseURL: publicBaseURL(r)}
+	if len(req.Settings.ModelConfig) > 0 {
+		config := req.Settings.ModelConfig[0]
+		if config.NumberOfImages > 0 {
+			opts.N = config.NumberOfImages
+		}
+		if config.AspectRatio != "" {
+			opts.AspectRatio = config.AspectRatio
+		}
+	}
+	opts.NegativePrompt = req.Settings.NegativePrompt
+	opts.PromptMagic = req.Settings.MerlinPromptMagic
+	applyCacheControl(r, &opts)
+	generateImage(ctx, w, flusher, req.Action.Message.Content, opts)
 }
 
 func HandleImageGenerations(w http.ResponseWriter, r *http.Request) {
@@ -1307,10 +1119,29 @@ func HandleImageGenerations(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	opts, err := imageRequestOptions(r, &req)
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+
+	ctx, done := beginFlow(r)
+	defer done()
+
+	// 生成图片，以 JSON 返回
+	data, err := createImages(ctx, req, opts)
+	if err != nil {
+		respondError(ctx, w, nil, err, false)
+		return
+	}
+	handleImageResponse(w, req.Model, data)
+}
+
+// imageRequestOptions 为 OpenAI 图片生成请求设置默认值，校验参数并转换为生成参数
+func imageRequestOptions(r *http.Request, req *OpenAIImageGenerationRequest) (imageOptions, error) {
 	// 验证必需字段
 	if req.Prompt == "" {
-		sendErrorResponse(w, "Prompt is required", "invalid_request_error", http.StatusBadRequest)
-		return
+		return imageOptions{}, errors.New("Prompt is required")
 	}
 
 	// 设置默认值
@@ -1323,14 +1154,34 @@ func HandleImageGenerations(w http.ResponseWriter, r *http.Request) {
 	if req.Model == "" {
 		req.Model = "dall-e-3"
 	}
+	metrics.SetModel(r.Context(), req.Model)
 
-	// 获取 flusher
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		sendErrorResponse(w, "Streaming unsupported!", "internal_error", http.StatusInternalServerError)
-		return
+	opts, err := newImageOptions(req.Model, req.N, req.Size)
+	if err != nil {
+		return opts, err
 	}
+	opts, err = opts.withParams(req.Style, req.Quality, req.NegativePrompt, req.Seed, req.PromptMagic)
+	if err != nil {
+		return opts, err
+	}
+	if err := validateResponseFormat(req.ResponseFormat); err != nil {
+		return opts, err
+	}
+	opts.BaseURL = publicBaseURL(r)
+	applyCacheControl(r, &opts)
+	return opts, nil
+}
 
-	// 生成图片
-	generateImage(w, flusher, req.Prompt, req.Model)
+// createImages 生成图片并按 response_format 返回
+func createImages(ctx context.Context, req OpenAIImageGenerationRequest, opts imageOptions) ([]ImageData, error) {
+	images, err := generateImages(ctx, req.Prompt, opts, nil)
+	if err != nil {
+		return nil, err
+	}
+	data, err := imageData(ctx, req.Prompt, opts, images, req.ResponseFormat)
+	if err != nil {
+		log.Printf("错误: 下载图片失败: %v", err)
+		return nil, err
+	}
+	return data, nil
 }
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+const (
+	// spliceWindow 续写开头缓冲的字节数，用于去掉与已发送内容重复的部分
+	spliceWindow = 256
+	// minOverlap 重复部分至少这么长才去掉，避免误删偶然相同的几个字符
+	minOverlap = 8
+)
+
+const continuePrompt = `%s
+
+---
+Your previous reply to the message above was cut off. This is the part that was already sent:
+
+%s
+
+---
+Continue the reply exactly where it stopped. Do not repeat any of the text above and do not add any preamble.`
+
+// continuePolicy 流中断后续写的配置，默认关闭
+type continuePolicy struct {
+	enabled     bool
+	maxAttempts int
+}
+
+func continuePolicyFromEnv() continuePolicy {
+	return continuePolicy{
+		enabled:     utils.GetEnvOrDefault("MERLIN_STREAM_CONTINUE", "false") == "true",
+		maxAttempts: utils.GetEnvInt("MERLIN_STREAM_CONTINUE_MAX", 2),
+	}
+}
+
+// shouldContinue 判断第 attempt 次续写是否可行：已经有部分回答，且中断原因是连接问题或上游没有结束就关闭了流
+func (p continuePolicy) shouldContinue(ctx context.Context, attempt int, answer string, err error) bool {
+	if !p.enabled || attempt > p.maxAttempts || answer == "" || ctx.Err() != nil {
+		return false
+	}
+	return err == nil || upstream.Retryable(err) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// continueRequest 构造续写请求：在新会话中带上原问题和已发送的内容
+func continueRequest(merlinReq MerlinRequest, answer string) MerlinRequest {
+	req := merlinReq
+	req.ChatID = uuid.New().String()
+	req.Message.ID = uuid.New().String()
+	req.Message.ChildID = uuid.New().String()
+	req.Message.ParentID = "root"
+	req.Message.Content = fmt.Sprintf(continuePrompt, merlinReq.Message.Content, answer)
+	return req
+}
+
+// splicer 缓冲续写的开头，去掉与已发送内容末尾重复的部分后再交给 emit
+type splicer struct {
+	previous string
+	buf      strings.Builder
+	emit     func(text string) error
+	flushed  bool
+}
+
+func newSplicer(previous string, emit func(text string) error) *splicer {
+	return &splicer{previous: previous, emit: emit}
+}
+
+func (s *splicer) write(text string) error {
+	if s.flushed {
+		return s.emit(text)
+	}
+	s.buf.WriteString(text)
+	if s.buf.Len() < spliceWindow {
+		return nil
+	}
+	return s.flush()
+}
+
+// flush 发送缓冲的内容，续写结束或出错时也要调用
+func (s *splicer) flush() error {
+	if s.flushed {
+		return nil
+	}
+	s.flushed = true
+	text := trimOverlap(s.previous, s.buf.String())
+	if text == "" {
+		return nil
+	}
+	return s.emit(text)
+}
+
+// trimOverlap 去掉 next 开头与 previous 末尾重复的最长部分
+func trimOverlap(previous, next string) string {
+	n := len(next)
+	if len(previous) < n {
+		n = len(previous)
+	}
+	for k := n; k >= minOverlap; k-- {
+		if strings.HasSuffix(previous, next[:k]) {
+			return next[k:]
+		}
+	}
+	return next
+}
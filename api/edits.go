@@ -0,0 +1,264 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+
+	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/profile"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// Wallflower 的功能类型
+const (
+	featureGenerate  = "GENERATE"
+	featureEdit      = "EDIT"
+	featureVariation = "VARIATION"
+)
+
+// Merlin 附件类型
+const (
+	attachmentImage = "IMAGE"
+	attachmentMask  = "MASK"
+)
+
+// errUpload 上传图片到 Merlin 失败
+var errUpload = errors.New("upload image failed")
+
+// upload 客户端上传的一张图片
+type upload struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// HandleImageEdits 处理 OpenAI 的 /v1/images/edits：按提示词修改上传的图片，可选的 mask 标出要修改的区域
+func HandleImageEdits(w http.ResponseWriter, r *http.Request) {
+	handleImageUpload(w, r, featureEdit)
+}
+
+// HandleImageVariations 处理 OpenAI 的 /v1/images/variations：生成上传图片的变体
+func HandleImageVariations(w http.ResponseWriter, r *http.Request) {
+	handleImageUpload(w, r, featureVariation)
+}
+
+// handleImageUpload 解析 multipart 请求，把图片作为附件上传到 Merlin 后按 feature 生成图片
+func handleImageUpload(w http.ResponseWriter, r *http.Request, feature string) {
+	// 设置 CORS 头
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method not allowed", "invalid_request_error", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// 图片和 mask 各自受 MERLIN_IMAGE_MAX_BYTES 限制，再留出表单字段的空间
+	maxBytes := int64(utils.GetEnvInt("MERLIN_IMAGE_MAX_BYTES", 20<<20))
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxBytes+1<<20)
+	if err := r.ParseMultipartForm(maxBytes); err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, fmt.Sprintf("invalid multipart request: %v", err)))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	prompt := r.FormValue("prompt")
+	if feature == featureEdit && prompt == "" {
+		sendErrorResponse(w, "Prompt is required", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	images, err := readUploads(r.MultipartForm, maxBytes, "image", "image[]")
+	if err == nil && len(images) == 0 {
+		err = errors.New("image is required")
+	}
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+	masks, err := readUploads(r.MultipartForm, maxBytes, "mask")
+	if err == nil && len(masks) > 0 && feature != featureEdit {
+		err = errors.New("mask is only supported by /v1/images/edits")
+	}
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+
+	// 设置默认值，与 OpenAI 一致
+	n := 1
+	if value := r.FormValue("n"); value != "" {
+		if n, err = strconv.Atoi(value); err != nil {
+			sendOpenAIError(w, withMessage(errInvalidRequest, fmt.Sprintf("invalid n %q", value)))
+			return
+		}
+	}
+	model := r.FormValue("model")
+	if model == "" {
+		model = "dall-e-2"
+	}
+	metrics.SetModel(r.Context(), model)
+
+	opts, err := newImageOptions(model, n, r.FormValue("size"))
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+	var seed *int
+	if value := r.FormValue("seed"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			sendOpenAIError(w, withMessage(errInvalidRequest, fmt.Sprintf("invalid seed %q", value)))
+			return
+		}
+		seed = &parsed
+	}
+	opts, err = opts.withParams(r.FormValue("style"), r.FormValue("quality"), r.FormValue("negative_prompt"), seed, r.FormValue("prompt_magic") == "true")
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+	format := r.FormValue("response_format")
+	if err := validateResponseFormat(format); err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+	opts.Type = feature
+	opts.BaseURL = publicBaseURL(r)
+
+	ctx, done := beginFlow(r)
+	defer done()
+
+	// 上传图片和 mask，作为附件发给 Wallflower
+	for _, image := range images {
+		attachment, err := uploadAttachment(ctx, attachmentImage, image)
+		if err != nil {
+			log.Printf("错误: 上传图片失败: %v", err)
+			respondError(ctx, w, nil, err, false)
+			return
+		}
+		opts.Attachments = append(opts.Attachments, attachment)
+	}
+	for _, mask := range masks {
+		attachment, err := uploadAttachment(ctx, attachmentMask, mask)
+		if err != nil {
+			log.Printf("错误: 上传 mask 失败: %v", err)
+			respondError(ctx, w, nil, err, false)
+			return
+		}
+		opts.Attachments = append(opts.Attachments, attachment)
+	}
+
+	generated, err := generateImages(ctx, prompt, opts, nil)
+	if err != nil {
+		respondError(ctx, w, nil, err, false)
+		return
+	}
+	data, err := imageData(ctx, prompt, opts, generated, format)
+	if err != nil {
+		log.Printf("错误: 下载图片失败: %v", err)
+		respondError(ctx, w, nil, err, false)
+		return
+	}
+	handleImageResponse(w, model, data)
+}
+
+// readUploads 读取表单中指定字段的图片，校验大小和类型
+func readUploads(form *multipart.Form, maxBytes int64, fields ...string) ([]upload, error) {
+	var uploads []upload
+	for _, field := range fields {
+		for _, header := range form.File[field] {
+			if header.Size > maxBytes {
+				return nil, fmt.Errorf("%s %s is larger than %d bytes", field, header.Filename, maxBytes)
+			}
+			file, err := header.Open()
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", field, err)
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %v", field, err)
+			}
+			// 按内容判断类型，不信任客户端声明的 Content-Type
+			contentType := http.DetectContentType(data)
+			if !imageContentTypes[contentType] {
+				return nil, fmt.Errorf("%s %s must be a png, jpeg, webp or gif image, got %s", field, header.Filename, contentType)
+			}
+			uploads = append(uploads, upload{name: header.Filename, contentType: contentType, data: data})
+		}
+	}
+	return uploads, nil
+}
+
+// uploadAttachment 把图片上传到 Merlin，返回可以放进 Wallflower 请求的附件
+func uploadAttachment(ctx context.Context, kind string, file upload) (merlin.Attachment, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename=%q`, file.name))
+	header.Set("Content-Type", file.contentType)
+	part, err := form.CreatePart(header)
+	if err != nil {
+		return merlin.Attachment{}, err
+	}
+	part.Write(file.data)
+	form.WriteField("type", kind)
+	if err := form.Close(); err != nil {
+		return merlin.Attachment{}, err
+	}
+
+	resp, _, err := doUpstream(ctx, func(ctx context.Context, account auth.Account, accessToken string) (*http.Request, error) {
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", upstream.ArcaneURL()+"/v1/wallflower/upload", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return nil, fmt.Errorf("error creating request: %w", err)
+		}
+
+		profile.ForAccount(account.ID).Apply(httpReq.Header)
+		httpReq.Header.Set("Content-Type", form.FormDataContentType())
+		httpReq.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		return httpReq, nil
+	})
+	if err != nil {
+		return merlin.Attachment{}, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data struct {
+			URL string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return merlin.Attachment{}, fmt.Errorf("%w: decode response: %v", errUpload, err)
+	}
+	if result.Data.URL == "" {
+		return merlin.Attachment{}, fmt.Errorf("%w: response has no url", errUpload)
+	}
+	log.Printf("图片上传成功: %s", result.Data.URL)
+	return merlin.Attachment{Type: kind, URL: result.Data.URL, Name: file.name}, nil
+}
+
+// validateResponseFormat 校验 OpenAI 图片接口的 response_format
+func validateResponseFormat(format string) error {
+	if format != "" && format != "url" && format != "b64_json" {
+		return fmt.Errorf("invalid response_format %q, expected url or b64_json", format)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+// apiError 返回给客户端的 OpenAI 格式错误
+type apiError struct {
+	Status  int
+	Type    string
+	Code    string
+	Message string
+}
+
+// 与 OpenAI 官方接口一致的错误类型
+var (
+	errAuthentication = apiError{Status: http.StatusUnauthorized, Type: "invalid_request_error", Code: "invalid_api_key"}
+	errQuota          = apiError{Status: http.StatusTooManyRequests, Type: "insufficient_quota", Code: "insufficient_quota"}
+	errRateLimit      = apiError{Status: http.StatusTooManyRequests, Type: "requests", Code: "rate_limit_exceeded"}
+	errContentPolicy  = apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "content_policy_violation"}
+	errModelNotFound  = apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "model_not_found"}
+	errNotFound       = apiError{Status: http.StatusNotFound, Type: "invalid_request_error", Code: "unknown_url"}
+	errInvalidRequest = apiError{Status: http.StatusBadRequest, Type: "invalid_request_error", Code: "invalid_request"}
+	errUpstream       = apiError{Status: http.StatusBadGateway, Type: "server_error", Code: "upstream_error"}
+	errUnavailable    = apiError{Status: http.StatusServiceUnavailable, Type: "server_error", Code: "service_unavailable"}
+	errTimeout        = apiError{Status: http.StatusGatewayTimeout, Type: "server_error", Code: "timeout"}
+	errInternal       = apiError{Status: http.StatusInternalServerError, Type: "server_error", Code: "internal_error"}
+	errShutdown       = apiError{Status: http.StatusServiceUnavailable, Type: "server_error", Code: "server_shutdown"}
+)
+
+// merlinErrorRules 按 Merlin 错误的 type 和 code 字段识别错误，按顺序匹配。
+// 不匹配 message：自由文本里出现的关键字（例如提到 quota 的普通错误）会让状态码判断失效
+var merlinErrorRules = []struct {
+	keywords []string
+	err      apiError
+}{
+	{[]string{"POLICY", "MODERATION", "NSFW", "SAFETY", "CONTENT_FILTER", "FLAGGED"}, errContentPolicy},
+	{[]string{"QUOTA", "CREDIT", "USAGE_LIMIT", "INSUFFICIENT", "LIMIT_REACHED", "UPGRADE"}, errQuota},
+	{[]string{"RATE_LIMIT", "TOO_MANY"}, errRateLimit},
+	{[]string{"MODEL_NOT", "MODEL_UNAVAILABLE", "INVALID_MODEL", "UNSUPPORTED_MODEL"}, errModelNotFound},
+	{[]string{"UNAUTHORI", "UNAUTHENTICATED", "FORBIDDEN", "INVALID_TOKEN", "TOKEN_EXPIRED"}, errAuthentication},
+}
+
+// classifyError 把上游或内部错误映射为 OpenAI 的状态码、error.type 和 error.code
+func classifyError(ctx context.Context, err error) apiError {
+	if isCut(ctx) || errors.Is(err, errShuttingDown) {
+		return withMessage(errShutdown, errShuttingDown.Error())
+	}
+
+	var event merlin.ErrorEvent
+	if errors.As(err, &event) {
+		return classifyMerlin(0, event.Type+" "+event.Code, event.Message)
+	}
+
+	if errors.Is(err, errImageFetch) || errors.Is(err, errUpload) ||
+		errors.Is(err, errStreamTruncated) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return withMessage(errUpstream, err.Error())
+	}
+
+	var statusErr *upstream.StatusError
+	if errors.As(err, &statusErr) {
+		kind, message := "", strings.TrimSpace(string(statusErr.Body))
+		if events, parseErr := merlin.Parse("", string(statusErr.Body)); parseErr == nil {
+			for _, e := range events {
+				if e, ok := e.(merlin.ErrorEvent); ok {
+					kind, message = e.Type+" "+e.Code, e.Message
+				}
+			}
+		}
+		if message == "" || message == "{}" {
+			message = http.StatusText(statusErr.StatusCode)
+		}
+		return classifyMerlin(statusErr.StatusCode, kind, message)
+	}
+
+	if errors.Is(err, auth.ErrNoValidToken) {
+		return withMessage(errAuthentication, err.Error())
+	}
+	if errors.Is(err, upstream.ErrStreamIdle) || errors.Is(err, context.DeadlineExceeded) {
+		return withMessage(errTimeout, err.Error())
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return withMessage(errTimeout, err.Error())
+		}
+		return withMessage(errUpstream, err.Error())
+	}
+	return withMessage(errInternal, err.Error())
+}
+
+// classifyMerlin 先按错误的 type 和 code 识别，识别不出时按上游状态码映射，status 为 0 表示流中的错误事件
+func classifyMerlin(status int, kind string, message string) apiError {
+	text := strings.ToUpper(kind)
+	for _, rule := range merlinErrorRules {
+		for _, keyword := range rule.keywords {
+			if strings.Contains(text, keyword) {
+				return withMessage(rule.err, message)
+			}
+		}
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return withMessage(errAuthentication, message)
+	case status == http.StatusPaymentRequired:
+		return withMessage(errQuota, message)
+	case status == http.StatusTooManyRequests:
+		return withMessage(errRateLimit, message)
+	case status == http.StatusNotFound:
+		return withMessage(errModelNotFound, message)
+	case status == http.StatusServiceUnavailable:
+		return withMessage(errUnavailable, message)
+	case status == http.StatusGatewayTimeout:
+		return withMessage(errTimeout, message)
+	case status >= 400 && status < 500:
+		return withMessage(errInvalidRequest, message)
+	}
+	return withMessage(errUpstream, message)
+}
+
+func withMessage(e apiError, message string) apiError {
+	e.Message = message
+	return e
+}
+
+// respondError 按 OpenAI 格式返回错误：流已经开始时发送一个错误事件，否则返回对应状态码的 JSON。
+// 因服务关闭被中断的流在错误事件后再发送 [DONE]，让客户端知道流已经结束
+func respondError(ctx context.Context, w http.ResponseWriter, flusher http.Flusher, err error, streaming bool) {
+	e := classifyError(ctx, err)
+	if streaming {
+		writeStreamError(w, flusher, e.Message, e.Type, e.Code)
+		if e.Code == errShutdown.Code {
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			flusher.Flush()
+		}
+		return
+	}
+	sendOpenAIError(w, e)
+}
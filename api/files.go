@@ -0,0 +1,101 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rubleowen/GetMerlin2Api/imagestore"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// filesPath 保存的图片通过 /files/{id} 访问
+const filesPath = "/files/"
+
+var (
+	imageStoreMu sync.RWMutex
+	imageStore   imagestore.Store
+)
+
+// InitImageStore 根据环境变量创建图片存储，未配置 IMAGE_STORE 时不保存图片
+func InitImageStore() error {
+	store, err := imagestore.FromEnv()
+	if err != nil {
+		return err
+	}
+	SetImageStore(store)
+	return nil
+}
+
+// SetImageStore 替换图片存储（nil 表示不保存），返回的函数用于恢复原存储
+func SetImageStore(store imagestore.Store) func() {
+	imageStoreMu.Lock()
+	previous := imageStore
+	imageStore = store
+	imageStoreMu.Unlock()
+	return func() {
+		imageStoreMu.Lock()
+		imageStore = previous
+		imageStoreMu.Unlock()
+	}
+}
+
+func currentImageStore() imagestore.Store {
+	imageStoreMu.RLock()
+	defer imageStoreMu.RUnlock()
+	return imageStore
+}
+
+// publicBaseURL 返回客户端访问本服务的地址，优先使用 PUBLIC_BASE_URL，其次按请求和反向代理头推断
+func publicBaseURL(r *http.Request) string {
+	if base := utils.GetEnvOrDefault("PUBLIC_BASE_URL", ""); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
+
+// HandleFiles 返回保存的图片，图片内容不会变化，允许客户端和 CDN 长期缓存
+func HandleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		sendErrorResponse(w, "Method not allowed", "invalid_request_error", http.StatusMethodNotAllowed)
+		return
+	}
+
+	store := currentImageStore()
+	id := strings.TrimPrefix(r.URL.Path, filesPath)
+	if store == nil || !imagestore.ValidID(id) {
+		sendErrorResponse(w, "File not found", "invalid_request_error", http.StatusNotFound)
+		return
+	}
+
+	meta, data, err := store.Get(r.Context(), id)
+	if errors.Is(err, imagestore.ErrNotFound) {
+		sendErrorResponse(w, "File not found", "invalid_request_error", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("错误: 读取图片 %s 失败: %v", id, err)
+		sendErrorResponse(w, "Failed to read file", "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", meta.ContentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+id+`"`)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeContent(w, r, "", meta.CreatedAt, bytes.NewReader(data))
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+var startedAt = time.Now()
+
+func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, must-revalidate")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(v)
+}
+
+// HandleHealthz 进程存活检查，只要能处理请求就返回 200
+func HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// HandleReadyz 就绪检查：至少一个账号持有有效token时返回 200，排空期间始终返回 503。
+// 只读取已有的token状态，没有有效token时在后台触发一次刷新，探针请求本身不访问上游
+func HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	if drainFrom(r.Context()).Draining() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "draining"})
+		return
+	}
+
+	if !auth.Ready() {
+		auth.RefreshInBackground()
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{
+			"status": "unavailable",
+			"error":  "no account has a valid token",
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// HandleDebugStatus 返回每个账号的token过期时间、最近的上游错误和进行中的请求数，需要 ADMIN_KEY
+func HandleDebugStatus(w http.ResponseWriter, r *http.Request) {
+	adminKey := utils.GetEnvOrDefault("ADMIN_KEY", "")
+	if adminKey == "" {
+		sendErrorResponse(w, "Admin endpoints are disabled, set ADMIN_KEY to enable", "invalid_request_error", http.StatusForbidden)
+		return
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(adminKey)) != 1 {
+		sendErrorResponse(w, "Invalid admin key", "invalid_request_error", http.StatusUnauthorized)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ready":          auth.Ready(),
+		"draining":       drainFrom(r.Context()).Draining(),
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"accounts":       auth.Status(),
+	})
+}
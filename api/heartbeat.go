@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/sse"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// heartbeatWriter 包装流式响应，在一个间隔内没有写出任何数据时发送 ": ping" 注释，
+// 防止推理模型长时间思考时反向代理或客户端超时。SSE 注释会被 OpenAI 客户端忽略
+type heartbeatWriter struct {
+	http.ResponseWriter
+	flusher  http.Flusher
+	interval time.Duration
+
+	mu    sync.Mutex
+	last  time.Time
+	wrote bool
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func heartbeatIntervalFromEnv() time.Duration {
+	return utils.GetEnvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second)
+}
+
+// startHeartbeat 开始发送心跳，interval 不大于 0 时只做包装不发送心跳。调用方必须在返回前调用 Stop
+func startHeartbeat(w http.ResponseWriter, flusher http.Flusher, interval time.Duration) *heartbeatWriter {
+	h := &heartbeatWriter{
+		ResponseWriter: w,
+		flusher:        flusher,
+		interval:       interval,
+		last:           time.Now(),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	if interval <= 0 {
+		close(h.done)
+		return h
+	}
+	go h.run()
+	return h
+}
+
+func (h *heartbeatWriter) run() {
+	defer close(h.done)
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.ping()
+		}
+	}
+}
+
+func (h *heartbeatWriter) ping() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.last) < h.interval {
+		return
+	}
+	if err := sse.WriteComment(h.ResponseWriter, "ping"); err != nil {
+		return
+	}
+	h.flusher.Flush()
+	h.last = time.Now()
+	h.wrote = true
+}
+
+func (h *heartbeatWriter) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+	h.wrote = true
+	return h.ResponseWriter.Write(p)
+}
+
+func (h *heartbeatWriter) Flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.flusher.Flush()
+}
+
+// Started 表示是否已经向客户端写出过数据（包括心跳），此后出错只能发送错误事件
+func (h *heartbeatWriter) Started() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.wrote
+}
+
+// Stop 停止心跳并等待后台协程退出，之后不会再有并发写入
+func (h *heartbeatWriter) Stop() {
+	select {
+	case <-h.stop:
+	default:
+		close(h.stop)
+	}
+	<-h.done
+}
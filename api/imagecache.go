@@ -0,0 +1,168 @@
+package api
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// imageCache 按生成参数缓存 Merlin 返回的图片。go-cache 负责过期，list 记录最近使用顺序，
+// 超过 size 时淘汰最久未使用的结果
+type imageCache struct {
+	mu    sync.Mutex
+	items *cache.Cache
+	order *list.List
+	index map[string]*list.Element
+	size  int
+}
+
+func newImageCache(ttl time.Duration, size int) *imageCache {
+	if size < 1 {
+		size = 1
+	}
+	return &imageCache{
+		// 不启动 go-cache 的定期清理协程：过期项在读取时判断，容量由 LRU 限制
+		items: cache.New(ttl, 0),
+		order: list.New(),
+		index: make(map[string]*list.Element),
+		size:  size,
+	}
+}
+
+func (c *imageCache) get(key string) ([]merlin.Variation, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok := c.items.Get(key)
+	if !ok {
+		// 已过期的结果不再占用容量
+		if e, exists := c.index[key]; exists {
+			c.order.Remove(e)
+			delete(c.index, key)
+		}
+		return nil, false
+	}
+	c.order.MoveToFront(c.index[key])
+	return value.([]merlin.Variation), true
+}
+
+func (c *imageCache) set(key string, images []merlin.Variation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items.SetDefault(key, images)
+	if e, ok := c.index[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.index[key] = c.order.PushFront(key)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.index, oldest.Value.(string))
+		c.items.Delete(oldest.Value.(string))
+	}
+}
+
+var (
+	imageCacheMu      sync.RWMutex
+	currentImageCache *imageCache
+)
+
+// InitImageCache 根据 IMAGE_CACHE_TTL 和 IMAGE_CACHE_SIZE 启用图片结果缓存，TTL 为 0（默认）时不缓存
+func InitImageCache() {
+	SetImageCache(utils.GetEnvDuration("IMAGE_CACHE_TTL", 0), utils.GetEnvInt("IMAGE_CACHE_SIZE", 1000))
+}
+
+// SetImageCache 替换图片结果缓存，ttl 为 0 时关闭缓存，返回的函数用于恢复原缓存
+func SetImageCache(ttl time.Duration, size int) func() {
+	var c *imageCache
+	if ttl > 0 {
+		c = newImageCache(ttl, size)
+	}
+	imageCacheMu.Lock()
+	previous := currentImageCache
+	currentImageCache = c
+	imageCacheMu.Unlock()
+	return func() {
+		imageCacheMu.Lock()
+		currentImageCache = previous
+		imageCacheMu.Unlock()
+	}
+}
+
+func loadImageCache() *imageCache {
+	imageCacheMu.RLock()
+	defer imageCacheMu.RUnlock()
+	return currentImageCache
+}
+
+// imageCacheKey 由提示词和影响结果的生成参数计算缓存键，编辑和变体依赖上传的图片，不缓存
+func imageCacheKey(prompt string, opts imageOptions) (string, bool) {
+	if opts.featureType() != featureGenerate || len(opts.Attachments) > 0 {
+		return "", false
+	}
+	data, _ := json.Marshal(struct {
+		Prompt         string
+		Model          string
+		AspectRatio    string
+		N              int
+		Seed           *int
+		Style          string
+		NegativePrompt string
+		PromptMagic    bool
+	}{prompt, opts.modelID(), opts.AspectRatio, opts.N, opts.Seed, opts.merlinStyle(), opts.NegativePrompt, opts.PromptMagic})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// cachedImages 返回缓存的结果，请求要求不使用缓存时跳过
+func cachedImages(prompt string, opts imageOptions) ([]merlin.Variation, bool) {
+	c := loadImageCache()
+	key, ok := imageCacheKey(prompt, opts)
+	if c == nil || !ok {
+		return nil, false
+	}
+	if opts.NoCache {
+		metrics.ImageCacheRequestsTotal.WithLabelValues("bypass").Inc()
+		return nil, false
+	}
+	images, hit := c.get(key)
+	if hit {
+		metrics.ImageCacheRequestsTotal.WithLabelValues("hit").Inc()
+	} else {
+		metrics.ImageCacheRequestsTotal.WithLabelValues("miss").Inc()
+	}
+	return images, hit
+}
+
+// storeImages 缓存生成的结果，请求带有 no-store 时不缓存
+func storeImages(prompt string, opts imageOptions, images []merlin.Variation) {
+	c := loadImageCache()
+	key, ok := imageCacheKey(prompt, opts)
+	if c == nil || !ok || opts.NoStore {
+		return
+	}
+	c.set(key, images)
+}
+
+// applyCacheControl 按请求的 Cache-Control 设置是否读取和写入缓存
+func applyCacheControl(r *http.Request, opts *imageOptions) {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			opts.NoCache = true
+		case "no-store":
+			opts.NoCache = true
+			opts.NoStore = true
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/imagestore"
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+	"golang.org/x/image/webp"
+)
+
+// errImageFetch 下载上游生成的图片失败
+var errImageFetch = errors.New("fetch generated image failed")
+
+// imageContentTypes 允许下载的图片类型
+var imageContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/webp": true,
+	"image/gif":  true,
+}
+
+// imageFetchConfig 下载图片的限制
+type imageFetchConfig struct {
+	timeout   time.Duration
+	maxBytes  int64
+	webpToPNG bool
+}
+
+func imageFetchConfigFromEnv() imageFetchConfig {
+	return imageFetchConfig{
+		timeout:   utils.GetEnvDuration("MERLIN_IMAGE_FETCH_TIMEOUT", 30*time.Second),
+		maxBytes:  int64(utils.GetEnvInt("MERLIN_IMAGE_MAX_BYTES", 20<<20)),
+		webpToPNG: utils.GetEnvOrDefault("IMAGE_WEBP_TO_PNG", "false") == "true",
+	}
+}
+
+// imageData 按 response_format 生成响应中的图片列表。配置了图片存储时把每张图片保存下来并把 URL
+// 换成本服务的 /files/{id}，保存失败时保留上游 URL；b64_json 时直接返回图片内容。每张图片并发处理，只下载一次
+func imageData(ctx context.Context, prompt string, opts imageOptions, images []merlin.Variation, format string) ([]ImageData, error) {
+	data := make([]ImageData, len(images))
+	for i, image := range images {
+		seed := image.Seed
+		data[i] = ImageData{URL: image.URL, RevisedPrompt: prompt, Seed: &seed, IID: image.IID}
+	}
+	store := currentImageStore()
+	if store == nil && format != "b64_json" {
+		return data, nil
+	}
+
+	cfg := imageFetchConfigFromEnv()
+	errs := make([]error, len(images))
+	var wg sync.WaitGroup
+	for i := range data {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, contentType, err := fetchImage(ctx, cfg, images[i].URL)
+			if err != nil {
+				if format == "b64_json" {
+					errs[i] = err
+				} else {
+					log.Printf("Warning: 保存图片失败，返回上游链接: %v", err)
+				}
+				return
+			}
+			if store != nil {
+				if url, err := storeImage(ctx, store, prompt, opts, images[i], body, contentType); err != nil {
+					log.Printf("Warning: 保存图片失败，返回上游链接: %v", err)
+				} else {
+					data[i].URL = url
+				}
+			}
+			if format == "b64_json" {
+				if contentType == "image/webp" && cfg.webpToPNG {
+					if body, err = webpToPNG(body); err != nil {
+						errs[i] = fmt.Errorf("%w: convert %s: %v", errImageFetch, images[i].URL, err)
+						return
+					}
+				}
+				data[i].URL = ""
+				data[i].B64JSON = base64.StdEncoding.EncodeToString(body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// storeImage 保存一张图片和它的生成参数，返回图片的访问地址
+func storeImage(ctx context.Context, store imagestore.Store, prompt string, opts imageOptions, image merlin.Variation, body []byte, contentType string) (string, error) {
+	meta := imagestore.Metadata{
+		ID:          imagestore.NewID(),
+		Prompt:      prompt,
+		Model:       opts.Model,
+		Seed:        image.Seed,
+		IID:         image.IID,
+		SourceURL:   image.URL,
+		ContentType: contentType,
+		Size:        len(body),
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := store.Put(ctx, meta, body); err != nil {
+		return "", fmt.Errorf("store %s: %w", image.URL, err)
+	}
+	return opts.BaseURL + filesPath + meta.ID, nil
+}
+
+// fetchImage 下载一张图片，限制下载时间、大小和类型
+func fetchImage(ctx context.Context, cfg imageFetchConfig, url string) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errImageFetch, err)
+	}
+	resp, err := upstream.Client().Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errImageFetch, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%w: %s returned status %d", errImageFetch, url, resp.StatusCode)
+	}
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !imageContentTypes[contentType] {
+		return nil, "", fmt.Errorf("%w: %s has unexpected content type %q", errImageFetch, url, contentType)
+	}
+	if resp.ContentLength > cfg.maxBytes {
+		return nil, "", fmt.Errorf("%w: %s is larger than %d bytes", errImageFetch, url, cfg.maxBytes)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cfg.maxBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: read %s: %v", errImageFetch, url, err)
+	}
+	if int64(len(body)) > cfg.maxBytes {
+		return nil, "", fmt.Errorf("%w: %s is larger than %d bytes", errImageFetch, url, cfg.maxBytes)
+	}
+	return body, contentType, nil
+}
+
+// webpToPNG 把 webp 图片转换为 png
+func webpToPNG(data []byte) ([]byte, error) {
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
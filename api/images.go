@@ -0,0 +1,221 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+)
+
+const (
+	// maxImagesPerRequest Merlin 一次最多生成的图片数
+	maxImagesPerRequest = 4
+	// defaultImageModel OpenAI 的图片模型名映射到的 Merlin 模型
+	defaultImageModel = "flux-1.1-pro"
+)
+
+// errNoImages 上游正常结束但没有返回任何图片
+var errNoImages = errors.New("no valid image URLs found")
+
+// imageModels 对外的模型名到 Merlin ModelId，未列出的模型名原样传给上游
+var imageModels = map[string]string{
+	"recraft-v3":   "fal-ai/recraft-v3",
+	"flux-1.1-pro": "black-forest-labs/flux-1.1-pro",
+}
+
+// openAIImageModels OpenAI 的图片模型，请求这些模型时使用 defaultImageModel
+var openAIImageModels = map[string]bool{
+	"dall-e-2":    true,
+	"dall-e-3":    true,
+	"gpt-image-1": true,
+}
+
+// aspectRatios Merlin 支持的宽高比
+var aspectRatios = []struct {
+	name  string
+	ratio float64
+}{
+	{"1:1", 1},
+	{"16:9", 16.0 / 9},
+	{"9:16", 9.0 / 16},
+	{"4:3", 4.0 / 3},
+	{"3:4", 3.0 / 4},
+	{"3:2", 3.0 / 2},
+	{"2:3", 2.0 / 3},
+}
+
+// openAIImageStyles OpenAI 的 style 取值，按 Merlin 的 Auto 风格生成
+var openAIImageStyles = map[string]bool{
+	"vivid":   true,
+	"natural": true,
+}
+
+// imageQualities OpenAI 的 quality 取值
+var imageQualities = map[string]bool{
+	"standard": true,
+	"hd":       true,
+	"low":      true,
+	"medium":   true,
+	"high":     true,
+	"auto":     true,
+}
+
+// imageOptions 一次图片生成的参数
+type imageOptions struct {
+	// Model 客户端请求的模型名，用于响应和指标
+	Model       string
+	N           int
+	AspectRatio string
+	// BaseURL 本服务的访问地址，用于拼接保存后的图片链接
+	BaseURL string
+	// Type Wallflower 的功能类型，为空时按 GENERATE 处理
+	Type string
+	// Attachments 编辑和变体时上传的原图和 mask
+	Attachments []merlin.Attachment
+	// Style Merlin 的风格，为空时按 Auto 生成
+	Style          string
+	NegativePrompt string
+	// Seed 为空时由 Merlin 随机选择
+	Seed        *int
+	PromptMagic bool
+	// NoCache 不读取结果缓存，NoStore 不写入结果缓存，对应请求的 Cache-Control
+	NoCache bool
+	NoStore bool
+}
+
+// withParams 校验并设置 OpenAI 的 style、quality 和 Merlin 的扩展参数。
+// OpenAI 的 vivid、natural 和 quality 在 Merlin 中没有对应参数，只校验取值；其他 style 原样作为 Merlin 的风格
+func (o imageOptions) withParams(style, quality, negativePrompt string, seed *int, promptMagic bool) (imageOptions, error) {
+	if quality != "" && !imageQualities[quality] {
+		return o, fmt.Errorf("invalid quality %q, expected standard, hd, low, medium, high or auto", quality)
+	}
+	if seed != nil && *seed < 0 {
+		return o, fmt.Errorf("seed must be a non-negative integer")
+	}
+	if !openAIImageStyles[style] {
+		o.Style = style
+	}
+	o.NegativePrompt = negativePrompt
+	o.Seed = seed
+	o.PromptMagic = promptMagic
+	return o, nil
+}
+
+// merlinStyle 返回发给 Merlin 的风格
+func (o imageOptions) merlinStyle() string {
+	if o.Style == "" {
+		return "Auto"
+	}
+	return o.Style
+}
+
+// featureType 返回发给 Merlin 的功能类型
+func (o imageOptions) featureType() string {
+	if o.Type == "" {
+		return featureGenerate
+	}
+	return o.Type
+}
+
+// modelID 返回发给 Merlin 的 ModelId
+func (o imageOptions) modelID() string {
+	model := o.Model
+	if openAIImageModels[model] {
+		model = defaultImageModel
+	}
+	if id, ok := imageModels[model]; ok {
+		return id
+	}
+	return model
+}
+
+// newImageOptions 校验 OpenAI 请求中的 n、size 和 model 并转换为 Merlin 的参数
+func newImageOptions(model string, n int, size string) (imageOptions, error) {
+	if n < 1 || n > maxImagesPerRequest {
+		return imageOptions{}, fmt.Errorf("n must be between 1 and %d", maxImagesPerRequest)
+	}
+	ratio, err := aspectRatioForSize(size)
+	if err != nil {
+		return imageOptions{}, err
+	}
+	return imageOptions{Model: model, N: n, AspectRatio: ratio}, nil
+}
+
+// aspectRatioForSize 把 "1792x1024" 这样的尺寸映射到最接近的 Merlin 宽高比，"auto" 按 1:1 处理
+func aspectRatioForSize(size string) (string, error) {
+	if size == "" || size == "auto" {
+		return "1:1", nil
+	}
+	width, height, ok := strings.Cut(strings.ToLower(size), "x")
+	w, errW := strconv.Atoi(width)
+	h, errH := strconv.Atoi(height)
+	if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+		return "", fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT such as 1024x1024", size)
+	}
+
+	target := math.Log(float64(w) / float64(h))
+	best := aspectRatios[0]
+	for _, candidate := range aspectRatios[1:] {
+		if math.Abs(math.Log(candidate.ratio)-target) < math.Abs(math.Log(best.ratio)-target) {
+			best = candidate
+		}
+	}
+	return best.name, nil
+}
+
+// imageMarkdown 把生成的图片写成聊天回复
+func imageMarkdown(urls []string) string {
+	progress := newImageProgress(len(urls))
+	var builder strings.Builder
+	for _, url := range urls {
+		builder.WriteString(progress.image(url))
+	}
+	return builder.String()
+}
+
+// imageProgress 把生成进度和陆续到达的图片写成聊天回复的增量文字
+type imageProgress struct {
+	total  int
+	images int
+	last   string
+}
+
+func newImageProgress(total int) *imageProgress {
+	return &imageProgress{total: total}
+}
+
+// status 返回一行进度，如 "generating 40% 1/2…"，与上一行相同时返回空字符串
+func (p *imageProgress) status(event merlin.ProgressEvent) string {
+	text := event.Status
+	if text == "" {
+		text = "generating"
+	}
+	if event.Percent >= 0 {
+		text += fmt.Sprintf(" %.0f%%", event.Percent)
+	}
+	if p.total > 1 {
+		text += fmt.Sprintf(" %d/%d", min(p.images+1, p.total), p.total)
+	}
+	text += "…"
+	if text == p.last {
+		return ""
+	}
+	p.last = text
+	return text + "\n"
+}
+
+// image 返回一张图片的 Markdown 链接，第一张图片前加上标题
+func (p *imageProgress) image(url string) string {
+	p.images++
+	prefix := ""
+	if p.images == 1 {
+		prefix = "生成的图片:"
+		if p.last != "" {
+			prefix = "\n" + prefix
+		}
+	}
+	return fmt.Sprintf("%s\n%d. ![image](%s)", prefix, p.images, url)
+}
@@ -0,0 +1,451 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// jobsPath 异步图片任务的接口路径
+const jobsPath = "/v1/images/jobs"
+
+// 图片任务的状态
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// errJobQueueFull 任务队列已满
+var errJobQueueFull = errors.New("image job queue is full, retry later")
+
+// ImageJobRequest 创建异步图片任务的请求，在图片生成请求的基础上可以指定完成后通知的地址
+type ImageJobRequest struct {
+	OpenAIImageGenerationRequest
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// ImageJob 异步图片任务，成功时 Result 与 /v1/images/generations 的响应相同
+type ImageJob struct {
+	ID          string                         `json:"id"`
+	Object      string                         `json:"object"`
+	Status      string                         `json:"status"`
+	Model       string                         `json:"model"`
+	CreatedAt   int64                          `json:"created_at"`
+	CompletedAt int64                          `json:"completed_at,omitempty"`
+	Result      *OpenAIImageGenerationResponse `json:"result,omitempty"`
+	Error       *ImageJobError                 `json:"error,omitempty"`
+}
+
+// ImageJobError 任务失败的原因，与 OpenAI 错误的字段一致
+type ImageJobError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+}
+
+// imageJob 任务和执行它需要的参数
+type imageJob struct {
+	ImageJob
+	req         OpenAIImageGenerationRequest
+	opts        imageOptions
+	callbackURL string
+	finished    time.Time
+}
+
+// imageJobConfig 任务队列和 webhook 的配置
+type imageJobConfig struct {
+	workers             int
+	queueSize           int
+	timeout             time.Duration
+	ttl                 time.Duration
+	webhookSecret       string
+	webhookTimeout      time.Duration
+	webhookAttempts     int
+	webhookRetryWait    time.Duration
+	webhookAllowedHosts map[string]bool
+}
+
+func imageJobConfigFromEnv() imageJobConfig {
+	return imageJobConfig{
+		workers:             utils.GetEnvInt("IMAGE_JOB_WORKERS", 4),
+		queueSize:           utils.GetEnvInt("IMAGE_JOB_QUEUE_SIZE", 100),
+		timeout:             utils.GetEnvDuration("IMAGE_JOB_TIMEOUT", 5*time.Minute),
+		ttl:                 utils.GetEnvDuration("IMAGE_JOB_TTL", time.Hour),
+		webhookSecret:       utils.GetEnvOrDefault("IMAGE_JOB_WEBHOOK_SECRET", ""),
+		webhookTimeout:      utils.GetEnvDuration("IMAGE_JOB_WEBHOOK_TIMEOUT", 10*time.Second),
+		webhookAttempts:     utils.GetEnvInt("IMAGE_JOB_WEBHOOK_ATTEMPTS", 3),
+		webhookRetryWait:    utils.GetEnvDuration("IMAGE_JOB_WEBHOOK_RETRY_WAIT", time.Second),
+		webhookAllowedHosts: parseAllowedHosts(utils.GetEnvOrDefault("IMAGE_JOB_WEBHOOK_ALLOWED_HOSTS", "")),
+	}
+}
+
+// imageJobRunner 固定数量的 worker 从有界队列中取出任务执行，任务结果在内存中保留 ttl
+type imageJobRunner struct {
+	cfg      imageJobConfig
+	queue    chan *imageJob
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	workers  sync.WaitGroup
+	webhooks sync.WaitGroup
+	client   *http.Client
+
+	mu     sync.Mutex
+	jobs   map[string]*imageJob
+	closed bool
+}
+
+var (
+	imageJobsMu sync.RWMutex
+	imageJobs   *imageJobRunner
+)
+
+// StartImageJobs 按环境变量启动图片任务的 worker。返回的函数停止接收新任务并等待队列中的任务完成，
+// ctx 到期后中断剩余的任务
+func StartImageJobs() func(ctx context.Context) {
+	runner := newImageJobRunner(imageJobConfigFromEnv())
+	imageJobsMu.Lock()
+	imageJobs = runner
+	imageJobsMu.Unlock()
+	return func(ctx context.Context) {
+		runner.stop(ctx)
+		imageJobsMu.Lock()
+		if imageJobs == runner {
+			imageJobs = nil
+		}
+		imageJobsMu.Unlock()
+	}
+}
+
+func currentImageJobs() *imageJobRunner {
+	imageJobsMu.RLock()
+	defer imageJobsMu.RUnlock()
+	return imageJobs
+}
+
+func newImageJobRunner(cfg imageJobConfig) *imageJobRunner {
+	if cfg.workers < 1 {
+		cfg.workers = 1
+	}
+	if cfg.queueSize < 0 {
+		cfg.queueSize = 0
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	r := &imageJobRunner{
+		cfg:    cfg,
+		queue:  make(chan *imageJob, cfg.queueSize),
+		ctx:    ctx,
+		cancel: cancel,
+		client: newWebhookClient(cfg.webhookTimeout, cfg.webhookAllowedHosts),
+		jobs:   make(map[string]*imageJob),
+	}
+	for i := 0; i < cfg.workers; i++ {
+		r.workers.Add(1)
+		go r.work()
+	}
+	go r.janitor()
+	return r
+}
+
+// submit 把任务放入队列，队列已满时立即返回 errJobQueueFull
+func (r *imageJobRunner) submit(job *imageJob) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return errShuttingDown
+	}
+	r.prune()
+
+	select {
+	case r.queue <- job:
+	default:
+		return errJobQueueFull
+	}
+	r.jobs[job.ID] = job
+	metrics.ImageJobsQueued.Inc()
+	return nil
+}
+
+// prune 删除完成超过 ttl 的任务，调用方持有 r.mu
+func (r *imageJobRunner) prune() {
+	for id, job := range r.jobs {
+		if !job.finished.IsZero() && time.Since(job.finished) > r.cfg.ttl {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// janitor 定期清理过期的任务，服务空闲时也不会一直保留
+func (r *imageJobRunner) janitor() {
+	ticker := time.NewTicker(max(r.cfg.ttl, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.mu.Lock()
+			r.prune()
+			r.mu.Unlock()
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+// get 返回任务当前状态的副本
+func (r *imageJobRunner) get(id string) (ImageJob, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	job, ok := r.jobs[id]
+	if !ok || (!job.finished.IsZero() && time.Since(job.finished) > r.cfg.ttl) {
+		return ImageJob{}, false
+	}
+	return job.ImageJob, true
+}
+
+func (r *imageJobRunner) work() {
+	defer r.workers.Done()
+	for job := range r.queue {
+		metrics.ImageJobsQueued.Dec()
+		r.run(job)
+	}
+}
+
+func (r *imageJobRunner) run(job *imageJob) {
+	r.mu.Lock()
+	job.Status = jobRunning
+	r.mu.Unlock()
+	log.Printf("开始执行图片任务 %s", job.ID)
+
+	var data []ImageData
+	var failure *ImageJobError
+	err := context.Cause(r.ctx)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(r.ctx, r.cfg.timeout)
+		if data, err = createImages(ctx, job.req, job.opts); err != nil {
+			failure = jobError(classifyError(ctx, err))
+		}
+		cancel()
+	} else {
+		failure = jobError(classifyError(r.ctx, err))
+	}
+
+	r.mu.Lock()
+	now := time.Now()
+	job.finished = now
+	job.CompletedAt = now.Unix()
+	if err != nil {
+		job.Status = jobFailed
+		job.Error = failure
+	} else {
+		job.Status = jobSucceeded
+		job.Result = &OpenAIImageGenerationResponse{Created: now.Unix(), Data: data}
+	}
+	snapshot := job.ImageJob
+	r.mu.Unlock()
+
+	metrics.ImageJobsTotal.WithLabelValues(snapshot.Status).Inc()
+	if err != nil {
+		log.Printf("图片任务 %s 失败: %v", job.ID, err)
+	} else {
+		log.Printf("图片任务 %s 完成，共 %d 张图片", job.ID, len(data))
+	}
+
+	if job.callbackURL != "" {
+		r.webhooks.Add(1)
+		go func() {
+			defer r.webhooks.Done()
+			r.deliver(job.callbackURL, snapshot)
+		}()
+	}
+}
+
+func jobError(e apiError) *ImageJobError {
+	return &ImageJobError{Message: e.Message, Type: e.Type, Code: e.Code}
+}
+
+// deliver 把任务结果 POST 到回调地址，失败时按固定间隔重试
+func (r *imageJobRunner) deliver(callbackURL string, job ImageJob) {
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("错误: 序列化任务 %s 失败: %v", job.ID, err)
+		return
+	}
+
+	for attempt := 1; attempt <= r.cfg.webhookAttempts; attempt++ {
+		err = r.post(callbackURL, job.ID, body)
+		if err == nil {
+			metrics.ImageJobWebhooksTotal.WithLabelValues("delivered").Inc()
+			log.Printf("图片任务 %s 的回调已送达", job.ID)
+			return
+		}
+		log.Printf("Webhook for image job %s failed (attempt %d): %v", job.ID, attempt, err)
+		if attempt == r.cfg.webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(r.cfg.webhookRetryWait):
+		case <-r.ctx.Done():
+			metrics.ImageJobWebhooksTotal.WithLabelValues("failed").Inc()
+			return
+		}
+	}
+	metrics.ImageJobWebhooksTotal.WithLabelValues("failed").Inc()
+}
+
+func (r *imageJobRunner) post(callbackURL, jobID string, body []byte) error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", jobID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(r.cfg.webhookSecret, timestamp, body))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook 计算 HMAC-SHA256(secret, timestamp + "." + body) 的十六进制签名
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// stop 停止接收新任务，等待 worker 处理完队列，ctx 到期后中断剩余任务
+func (r *imageJobRunner) stop(ctx context.Context) {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.workers.Wait()
+		r.webhooks.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("Image jobs did not finish in time, cancelling remaining jobs")
+		r.cancel(errShuttingDown)
+		<-done
+	}
+	r.cancel(nil)
+}
+
+// HandleImageJobs 处理 POST /v1/images/jobs（创建任务）和 GET /v1/images/jobs/{id}（查询任务）
+func HandleImageJobs(w http.ResponseWriter, r *http.Request) {
+	// 设置 CORS 头
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	runner := currentImageJobs()
+	if runner == nil {
+		sendOpenAIError(w, withMessage(errUnavailable, "image jobs are not enabled"))
+		return
+	}
+
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, jobsPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createImageJob(w, r, runner)
+	case id != "" && r.Method == http.MethodGet:
+		job, ok := runner.get(id)
+		if !ok {
+			sendErrorResponse(w, "Job not found", "invalid_request_error", http.StatusNotFound)
+			return
+		}
+		writeImageJob(w, http.StatusOK, job)
+	default:
+		sendErrorResponse(w, "Method not allowed", "invalid_request_error", http.StatusMethodNotAllowed)
+	}
+}
+
+func createImageJob(w http.ResponseWriter, r *http.Request, runner *imageJobRunner) {
+	var req ImageJobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendErrorResponse(w, "Invalid request body", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	opts, err := imageRequestOptions(r, &req.OpenAIImageGenerationRequest)
+	if err == nil && req.CallbackURL != "" {
+		err = validateCallbackURL(req.CallbackURL, runner.cfg)
+	}
+	if err != nil {
+		sendOpenAIError(w, withMessage(errInvalidRequest, err.Error()))
+		return
+	}
+
+	job := &imageJob{
+		ImageJob: ImageJob{
+			ID:        "imgjob_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Object:    "image.job",
+			Status:    jobQueued,
+			Model:     req.Model,
+			CreatedAt: time.Now().Unix(),
+		},
+		req:         req.OpenAIImageGenerationRequest,
+		opts:        opts,
+		callbackURL: req.CallbackURL,
+	}
+	// 入队后 worker 会修改任务，先保存返回给客户端的状态
+	queued := job.ImageJob
+	if err := runner.submit(job); err != nil {
+		metrics.ImageJobsTotal.WithLabelValues("rejected").Inc()
+		if errors.Is(err, errJobQueueFull) {
+			w.Header().Set("Retry-After", "5")
+			sendOpenAIError(w, withMessage(errRateLimit, err.Error()))
+			return
+		}
+		sendOpenAIError(w, withMessage(errShutdown, err.Error()))
+		return
+	}
+
+	log.Printf("图片任务 %s 已加入队列", job.ID)
+	w.Header().Set("Location", jobsPath+"/"+job.ID)
+	writeImageJob(w, http.StatusAccepted, queued)
+}
+
+func writeImageJob(w http.ResponseWriter, status int, job ImageJob) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("Error encoding image job: %v", err)
+	}
+}
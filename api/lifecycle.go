@@ -0,0 +1,132 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errShuttingDown 作为流被强制中断时 context 的 cause
+var errShuttingDown = errors.New("server is shutting down")
+
+// Drain 管理一个服务的优雅关闭：排空期间拒绝新请求，等待进行中的流结束，超时后中断剩余的流
+type Drain struct {
+	draining atomic.Bool
+	cutOnce  sync.Once
+	cutCh    chan struct{}
+	flows    sync.WaitGroup
+}
+
+// NewDrain 创建排空控制器，需要通过 WithDrain 挂到服务的 Handler 上
+func NewDrain() *Drain {
+	return &Drain{cutCh: make(chan struct{})}
+}
+
+// Draining 是否已进入排空状态
+func (d *Drain) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+// Begin 进入排空状态，之后到达的请求直接返回 503
+func (d *Drain) Begin() {
+	d.draining.Store(true)
+}
+
+// Cut 通知所有仍在进行的流立即结束，并向客户端发送错误块
+func (d *Drain) Cut() {
+	d.cutOnce.Do(func() { close(d.cutCh) })
+}
+
+// Wait 等待所有流结束，ctx 到期时返回 false
+func (d *Drain) Wait(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		d.flows.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Shutdown 停止接收新请求并等待进行中的流结束，drainCtx 到期后向剩余的流发送错误块并关闭服务
+func (d *Drain) Shutdown(drainCtx context.Context, server *http.Server) {
+	d.Begin()
+
+	if err := server.Shutdown(drainCtx); err == nil {
+		log.Printf("Server stopped gracefully")
+		return
+	}
+
+	log.Printf("Drain deadline exceeded, cutting remaining streams")
+	d.Cut()
+
+	cutCtx, cancelCut := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelCut()
+	if !d.Wait(cutCtx) {
+		log.Printf("Some streams did not finish after being cut")
+	}
+	server.Close()
+	log.Printf("Server stopped")
+}
+
+// 排空期间仍然放行的探针和监控路径
+var drainExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+type drainKey struct{}
+
+// drainFrom 返回请求所属服务的排空控制器，没有经过 WithDrain 时返回 nil
+func drainFrom(ctx context.Context) *Drain {
+	d, _ := ctx.Value(drainKey{}).(*Drain)
+	return d
+}
+
+// WithDrain 在排空期间拒绝新请求，并让处理函数通过请求的 context 找到排空控制器
+func WithDrain(d *Drain, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() && !drainExempt[r.URL.Path] {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "5")
+			sendErrorResponse(w, errShuttingDown.Error(), "server_error", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), drainKey{}, d)))
+	})
+}
+
+// beginFlow 登记一个进行中的请求，返回的 ctx 在客户端断开或服务强制中断时取消
+func beginFlow(r *http.Request) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(r.Context())
+	d := drainFrom(r.Context())
+	if d == nil {
+		return ctx, func() { cancel(nil) }
+	}
+	d.flows.Add(1)
+	go func() {
+		select {
+		case <-d.cutCh:
+			cancel(errShuttingDown)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		cancel(nil)
+		d.flows.Done()
+	}
+}
+
+// isCut 判断 ctx 是否因服务关闭被中断
+func isCut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errShuttingDown)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+// requestBuilder 为指定账号构造上游请求
+type requestBuilder func(ctx context.Context, account auth.Account, accessToken string) (*http.Request, error)
+
+// doUpstream 发送上游请求并返回状态码为 200 的响应和所用的账号。连接错误、429 和 5xx 按重试策略退避后重试，
+// 每次重试切换到下一个账号，每次失败都会记录到对应账号。响应体关闭时释放账号上的进行中计数
+func doUpstream(ctx context.Context, build requestBuilder) (*http.Response, auth.Account, error) {
+	accounts := auth.Accounts()
+	if len(accounts) == 0 {
+		return nil, auth.Account{}, auth.ErrNoValidToken
+	}
+
+	policy := upstream.RetryPolicyFromEnv()
+	for attempt := 0; ; attempt++ {
+		account := accounts[attempt%len(accounts)]
+		resp, err := sendUpstream(ctx, account, build)
+		if err == nil {
+			return resp, account, nil
+		}
+		recordUpstreamError(ctx, account.ID, err)
+
+		if attempt >= policy.MaxRetries || !upstream.Retryable(err) || ctx.Err() != nil {
+			return nil, auth.Account{}, err
+		}
+		log.Printf("Upstream request failed on account %s (attempt %d): %v, retrying", account.ID, attempt+1, err)
+		if waitErr := policy.Wait(ctx, attempt+1); waitErr != nil {
+			return nil, auth.Account{}, err
+		}
+	}
+}
+
+func sendUpstream(ctx context.Context, account auth.Account, build requestBuilder) (*http.Response, error) {
+	accessToken, err := account.AccessToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get access token failed: %w", err)
+	}
+
+	req, err := build(ctx, account, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	release := auth.Acquire(account.ID)
+	resp, err := upstream.Client().Do(req)
+	if err != nil {
+		release()
+		return nil, fmt.Errorf("upstream request failed: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		release()
+		log.Printf("Upstream returned status %d: %s", resp.StatusCode, string(body))
+		// access token 失效时丢弃缓存，下次重新获取
+		if resp.StatusCode == http.StatusUnauthorized {
+			account.Invalidate()
+		}
+		return nil, upstream.NewStatusError(resp, body)
+	}
+
+	resp.Body = &releaseBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releaseBody 在响应体关闭时调用 release
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
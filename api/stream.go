@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ChunkChoice 流式响应中的一个选项。finish_reason 在最后一块之前为 null，logprobs 始终为 null
+type ChunkChoice struct {
+	Index        int         `json:"index"`
+	Delta        Delta       `json:"delta"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+// chunkWriter 按 OpenAI 的 chat.completion.chunk 格式写出一个流，同一个流的所有块共用 id 和 created
+type chunkWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	id      string
+	created int64
+	model   string
+	// includeUsage 为 true 时与 OpenAI 一致，用量块之前的每一块都带 "usage":null
+	includeUsage bool
+}
+
+func newChunkWriter(w http.ResponseWriter, flusher http.Flusher, model string) *chunkWriter {
+	return &chunkWriter{
+		w:       w,
+		flusher: flusher,
+		id:      "chatcmpl-" + generateUUID(),
+		created: time.Now().Unix(),
+		model:   model,
+	}
+}
+
+// role 发送第一块，只包含角色
+func (c *chunkWriter) role() error {
+	return c.write(Delta{Role: "assistant"}, nil)
+}
+
+// content 发送一个内容块
+func (c *chunkWriter) content(text string) error {
+	return c.write(Delta{Content: text}, nil)
+}
+
+// finish 发送带 finish_reason 的空增量块；usage 不为 nil 时再发送一个 choices 为空的用量块，最后发送 [DONE]
+func (c *chunkWriter) finish(reason string, usage *Usage) error {
+	if err := c.write(Delta{}, &reason); err != nil {
+		return err
+	}
+	if usage != nil {
+		if err := c.send(OpenAIStreamResponse{Choices: []ChunkChoice{}, Usage: usage}); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(c.w, "data: [DONE]\n\n"); err != nil {
+		return fmt.Errorf("write response failed: %v", err)
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+func (c *chunkWriter) write(delta Delta, finishReason *string) error {
+	return c.send(OpenAIStreamResponse{
+		Choices: []ChunkChoice{
+			{
+				Index:        0,
+				Delta:        delta,
+				FinishReason: finishReason,
+			},
+		},
+	})
+}
+
+// send 补上流的 id、created 和 model 后写出一块
+func (c *chunkWriter) send(chunk OpenAIStreamResponse) error {
+	chunk.ID = c.id
+	chunk.Object = "chat.completion.chunk"
+	chunk.Created = c.created
+	chunk.Model = c.model
+	var value interface{} = chunk
+	if c.includeUsage {
+		value = struct {
+			OpenAIStreamResponse
+			Usage *Usage `json:"usage"`
+		}{chunk, chunk.Usage}
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c.w, "data: %s\n\n", data); err != nil {
+		return fmt.Errorf("write response failed: %v", err)
+	}
+	c.flusher.Flush()
+	return nil
+}
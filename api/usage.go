@@ -0,0 +1,46 @@
+package api
+
+import (
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/tokenizer"
+)
+
+const (
+	// tokensPerMessage 每条消息的格式开销，与 OpenAI 的计费方式一致
+	tokensPerMessage = 3
+	// tokensPerReply 每次回复前的固定开销
+	tokensPerReply = 3
+)
+
+// Usage OpenAI 格式的用量统计
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// StreamOptions 流式请求的选项
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatUsage 用本地分词器估算一次对话的用量。只有最后一条消息会发给上游，所以提示只计这一条
+func chatUsage(merlinReq MerlinRequest, completion string) Usage {
+	return estimateUsage(merlinReq.Model, merlinReq.Message.Content, completion)
+}
+
+// estimateUsage 估算一条用户消息和一条回复的用量并计入指标
+func estimateUsage(model string, prompt string, completion string) Usage {
+	encoding := tokenizer.ForModel(model)
+	promptTokens := tokensPerMessage + encoding.Count("user") + encoding.Count(prompt) + tokensPerReply
+	completionTokens := encoding.Count(completion)
+
+	label := metrics.ModelLabel(model)
+	metrics.TokensTotal.WithLabelValues(label, "prompt").Add(float64(promptTokens))
+	metrics.TokensTotal.WithLabelValues(label, "completion").Add(float64(completionTokens))
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errWebhookAddress 回调地址指向内网、本机或云厂商元数据等非公网地址
+var errWebhookAddress = errors.New("callback_url must resolve to a public address")
+
+// sharedAddressSpace 运营商级 NAT 使用的 100.64.0.0/10，net.IP 没有对应的判断方法
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicIP 判断地址是否可以作为回调目标，排除回环、私有、链路本地（含 169.254.169.254 元数据地址）、组播和未指定地址
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0))
+}
+
+// parseAllowedHosts 解析 IMAGE_JOB_WEBHOOK_ALLOWED_HOSTS，逗号分隔，忽略大小写
+func parseAllowedHosts(value string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// newWebhookClient 返回发送回调的客户端。白名单外的主机在连接时检查解析出的地址，
+// 非公网地址直接拒绝，防止通过域名解析绕过提交时的检查
+func newWebhookClient(timeout time.Duration, allowedHosts map[string]bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	restricted := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("%w: %s", errWebhookAddress, host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// 不走环境变量中的代理，否则检查的是代理的地址
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(address)
+				if err == nil && allowedHosts[strings.ToLower(host)] {
+					return dialer.DialContext(ctx, network, address)
+				}
+				return restricted.DialContext(ctx, network, address)
+			},
+			TLSHandshakeTimeout: timeout,
+		},
+		// 重定向可能指向内网，回调不跟随重定向
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// validateCallbackURL 回调地址必须是 http(s) 地址并且配置了签名密钥。配置了白名单时只接受白名单中的主机，
+// 否则拒绝直接写成非公网 IP 的地址，域名在连接时检查
+func validateCallbackURL(callbackURL string, cfg imageJobConfig) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid callback_url %q, expected an http or https url", callbackURL)
+	}
+	if cfg.webhookSecret == "" {
+		return errors.New("callback_url requires IMAGE_JOB_WEBHOOK_SECRET to be configured")
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(cfg.webhookAllowedHosts) > 0 {
+		if !cfg.webhookAllowedHosts[host] {
+			return fmt.Errorf("callback_url host %q is not in IMAGE_JOB_WEBHOOK_ALLOWED_HOSTS", host)
+		}
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicIP(ip) {
+		return errWebhookAddress
+	}
+	return nil
+}
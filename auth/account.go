@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// AccountID 返回当前账号的标识，优先使用 MERLIN_ACCOUNT_ID，否则由凭据哈希得出，避免在日志和配置中暴露token
+func AccountID() string {
+	if id := utils.GetEnvOrDefault("MERLIN_ACCOUNT_ID", ""); id != "" {
+		return id
+	}
+
+	for _, key := range []string{"MERLIN_SESSION_TOKEN", "MERLIN_REFRESH_TOKEN", "MERLIN_TOKEN"} {
+		if credential := utils.GetEnvOrDefault(key, ""); credential != "" {
+			return credentialID(credential)
+		}
+	}
+	return ""
+}
+
+// credentialID 由凭据哈希得出账号标识
+func credentialID(credential string) string {
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:6])
+}
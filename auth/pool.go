@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// Account 一个可以发起上游请求的 Merlin 账号
+type Account struct {
+	ID           string
+	SessionToken string
+	primary      bool
+}
+
+// Accounts 返回所有配置的账号。第一个是由 MERLIN_SESSION_TOKEN / MERLIN_REFRESH_TOKEN / MERLIN_TOKEN
+// 配置的主账号，其后是 MERLIN_BACKUP_SESSION_TOKENS（逗号分隔）配置的备用账号，上游故障时依次切换
+func Accounts() []Account {
+	var accounts []Account
+	if id := AccountID(); id != "" {
+		accounts = append(accounts, Account{
+			ID:           id,
+			SessionToken: utils.GetEnvOrDefault("MERLIN_SESSION_TOKEN", ""),
+			primary:      true,
+		})
+	}
+
+	for _, token := range strings.Split(utils.GetEnvOrDefault("MERLIN_BACKUP_SESSION_TOKENS", ""), ",") {
+		token = strings.TrimSpace(token)
+		if token == "" {
+			continue
+		}
+		accounts = append(accounts, Account{ID: credentialID(token), SessionToken: token})
+	}
+	return accounts
+}
+
+type accountToken struct {
+	token  string
+	expiry time.Time
+}
+
+var (
+	accountTokensMu sync.Mutex
+	accountTokens   = make(map[string]accountToken)
+)
+
+// AccessToken 获取账号的 access token 并缓存。主账号按 GenerateToken 的顺序尝试所有凭据，备用账号使用 session token
+func (a Account) AccessToken(ctx context.Context) (string, error) {
+	accountTokensMu.Lock()
+	cached, ok := accountTokens[a.ID]
+	accountTokensMu.Unlock()
+	if ok && time.Now().Before(cached.expiry) {
+		return cached.token, nil
+	}
+
+	var token string
+	var err error
+	if a.primary {
+		token, err = GenerateTokenWithContext(ctx)
+	} else {
+		token, err = fetchSessionToken(ctx, a.ID, a.SessionToken)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	accountTokensMu.Lock()
+	accountTokens[a.ID] = accountToken{token: token, expiry: time.Now().Add(refreshInterval)}
+	accountTokensMu.Unlock()
+	return token, nil
+}
+
+// Invalidate 丢弃账号缓存的 access token，上游返回 401 时调用
+func (a Account) Invalidate() {
+	accountTokensMu.Lock()
+	defer accountTokensMu.Unlock()
+	delete(accountTokens, a.ID)
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+)
+
+// AccountStatus 账号的运行状态，用于就绪检查和 /debug/status
+type AccountStatus struct {
+	ID          string     `json:"id"`
+	TokenValid  bool       `json:"token_valid"`
+	TokenExpiry *time.Time `json:"token_expiry,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	InFlight    int64      `json:"in_flight"`
+}
+
+type accountState struct {
+	hasToken    bool
+	tokenExpiry time.Time
+	lastError   string
+	lastErrorAt time.Time
+	inFlight    int64
+}
+
+var (
+	statesMu sync.Mutex
+	states   = make(map[string]*accountState)
+)
+
+func stateFor(id string) *accountState {
+	st, ok := states[id]
+	if !ok {
+		st = &accountState{}
+		states[id] = st
+	}
+	return st
+}
+
+// valid 判断token是否可用，expiry 为零表示静态token，不会过期
+func (st *accountState) valid(now time.Time) bool {
+	return st.hasToken && (st.tokenExpiry.IsZero() || now.Before(st.tokenExpiry))
+}
+
+// markToken 记录账号获取到了token
+func markToken(id string, expiry time.Time) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := stateFor(id)
+	st.hasToken = true
+	st.tokenExpiry = expiry
+
+	metrics.AccountTokenValid.WithLabelValues(id).Set(1)
+	if !expiry.IsZero() {
+		metrics.AccountTokenExpiry.WithLabelValues(id).Set(float64(expiry.Unix()))
+	}
+}
+
+// markTokenFailed 记录账号获取token失败
+func markTokenFailed(id string, err error) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := stateFor(id)
+	st.hasToken = false
+	st.lastError = err.Error()
+	st.lastErrorAt = time.Now()
+
+	metrics.AccountTokenValid.WithLabelValues(id).Set(0)
+}
+
+// RecordUpstreamError 记录账号最近一次上游错误
+func RecordUpstreamError(id string, err error) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st := stateFor(id)
+	st.lastError = err.Error()
+	st.lastErrorAt = time.Now()
+}
+
+// Acquire 登记账号上一个进行中的上游请求，返回的函数在请求结束时调用
+func Acquire(id string) func() {
+	statesMu.Lock()
+	stateFor(id).inFlight++
+	statesMu.Unlock()
+	metrics.AccountInflight.WithLabelValues(id).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			statesMu.Lock()
+			stateFor(id).inFlight--
+			statesMu.Unlock()
+			metrics.AccountInflight.WithLabelValues(id).Dec()
+		})
+	}
+}
+
+// Status 返回所有已知账号的状态
+func Status() []AccountStatus {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	now := time.Now()
+	result := make([]AccountStatus, 0, len(states))
+	for id, st := range states {
+		status := AccountStatus{
+			ID:         id,
+			TokenValid: st.valid(now),
+			LastError:  st.lastError,
+			InFlight:   st.inFlight,
+		}
+		if !st.tokenExpiry.IsZero() {
+			expiry := st.tokenExpiry
+			status.TokenExpiry = &expiry
+		}
+		if !st.lastErrorAt.IsZero() {
+			at := st.lastErrorAt
+			status.LastErrorAt = &at
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// Ready 判断是否至少有一个账号持有有效token
+func Ready() bool {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	now := time.Now()
+	for _, st := range states {
+		if st.valid(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetStatus 等待后台刷新结束并清空所有账号的状态，测试中切换上游后调用
+func ResetStatus() {
+	resetBackgroundRefresh()
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	states = make(map[string]*accountState)
+}
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,6 +12,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/profile"
+	"github.com/rubleowen/GetMerlin2Api/tracing"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
 	"github.com/rubleowen/GetMerlin2Api/utils"
 )
 
@@ -20,6 +26,9 @@ var (
 	refreshInterval = 55 * time.Minute // Token通常1小时过期，提前5分钟刷新
 )
 
+// ErrNoValidToken 所有凭据都无法换取 token
+var ErrNoValidToken = errors.New("no valid token found in environment variables")
+
 type SessionResponse struct {
 	User struct {
 		AccessToken string `json:"accessToken"`
@@ -43,33 +52,46 @@ type RefreshResponse struct {
 
 // GetSessionToken 从session.getmerlin.in获取token
 func GetSessionToken(sessionToken string) (string, error) {
+	return GetSessionTokenWithContext(context.Background(), sessionToken)
+}
+
+// GetSessionTokenWithContext 同 GetSessionToken，请求随 ctx 取消
+func GetSessionTokenWithContext(ctx context.Context, sessionToken string) (string, error) {
+	token, err := fetchSessionToken(ctx, AccountID(), sessionToken)
+	if err != nil {
+		return "", err
+	}
+
+	// 更新缓存
+	tokenLock.Lock()
+	cachedToken = token
+	cachedExpiry = time.Now().Add(refreshInterval)
+	tokenLock.Unlock()
+	return token, nil
+}
+
+// fetchSessionToken 用 session token 换取账号 id 的 access token，不更新缓存
+func fetchSessionToken(ctx context.Context, id string, sessionToken string) (token string, err error) {
+	ctx, span := tracing.Start(ctx, "auth.GetSessionToken", tracing.AttrAccount.String(id))
+	defer func() {
+		recordRefresh(id, "session", err)
+		tracing.End(span, err)
+	}()
+
 	log.Printf("Trying to get session token...")
-	req, err := http.NewRequest("GET", "https://session.getmerlin.in/?from=web", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", upstream.SessionURL()+"/?from=web", nil)
 	if err != nil {
 		return "", fmt.Errorf("create request failed: %v", err)
 	}
 
 	// 设置请求头
-	req.Header.Set("accept", "application/json, text/plain, */*")
-	req.Header.Set("accept-language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	req.Header.Set("cache-control", "no-cache")
-	req.Header.Set("origin", "https://www.getmerlin.in")
-	req.Header.Set("pragma", "no-cache")
-	req.Header.Set("referer", "https://www.getmerlin.in/")
-	req.Header.Set("sec-ch-ua", `"Google Chrome";v="131", "Chromium";v="131", "Not_A Brand";v="24"`)
-	req.Header.Set("sec-ch-ua-mobile", "?0")
-	req.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	req.Header.Set("sec-fetch-dest", "empty")
-	req.Header.Set("sec-fetch-mode", "cors")
-	req.Header.Set("sec-fetch-site", "same-site")
-	req.Header.Set("user-agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/131.0.0.0 Safari/537.36")
-	req.Header.Set("x-merlin-version", "web-merlin")
+	profile.ForAccount(id).Apply(req.Header)
+	req.Header.Set("Accept", "application/json, text/plain, */*")
 	req.Header.Set("cookie", fmt.Sprintf("__Secure-authjs.session-token=%s", sessionToken))
 
 	log.Printf("Sending request to session.getmerlin.in...")
 	// 发送请求
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := upstream.Client().Do(req)
 	if err != nil {
 		return "", fmt.Errorf("request failed: %v", err)
 	}
@@ -84,7 +106,7 @@ func GetSessionToken(sessionToken string) (string, error) {
 	log.Printf("Response from session.getmerlin.in: %s", string(body))
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("get session token failed: %s", string(body))
+		return "", fmt.Errorf("get session token failed: %w", upstream.NewStatusError(resp, body))
 	}
 
 	var sessionResp SessionResponse
@@ -96,17 +118,20 @@ func GetSessionToken(sessionToken string) (string, error) {
 		return "", fmt.Errorf("empty access token in response")
 	}
 
-	// 更新缓存
-	token := sessionResp.User.AccessToken
-	cachedToken = token
-	cachedExpiry = time.Now().Add(refreshInterval)
-
 	log.Printf("Successfully got session token")
-	return token, nil
+	return sessionResp.User.AccessToken, nil
 }
 
 // RefreshAuthToken 通过refresh token获取新的authorization token
 func RefreshAuthToken(refreshToken string) (string, error) {
+	return RefreshAuthTokenWithContext(context.Background(), refreshToken)
+}
+
+// RefreshAuthTokenWithContext 同 RefreshAuthToken，请求随 ctx 取消
+func RefreshAuthTokenWithContext(ctx context.Context, refreshToken string) (token string, err error) {
+	ctx, span := tracing.Start(ctx, "auth.RefreshAuthToken", tracing.AttrAccount.String(AccountID()))
+	defer func() { tracing.End(span, err) }()
+
 	log.Printf("Trying to refresh token...")
 	tokenLock.Lock()
 	defer tokenLock.Unlock()
@@ -116,6 +141,7 @@ func RefreshAuthToken(refreshToken string) (string, error) {
 		log.Printf("Using cached token")
 		return cachedToken, nil
 	}
+	defer func() { recordRefresh(AccountID(), "refresh", err) }()
 
 	// 准备请求体
 	reqBody := map[string]interface{}{
@@ -127,35 +153,24 @@ func RefreshAuthToken(refreshToken string) (string, error) {
 	}
 
 	// 创建请求
-	req, err := http.NewRequest("POST", "https://uam.getmerlin.in/session/get", bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", upstream.UAMURL()+"/session/get", bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("create request failed: %v", err)
 	}
 
 	// 设置请求头
+	profile.ForAccount(AccountID()).Apply(req.Header)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Origin", "https://www.getmerlin.in")
-	req.Header.Set("Referer", "https://www.getmerlin.in/")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
 	req.Header.Set("Accept", "application/json, text/plain, */*")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7")
-	req.Header.Set("x-merlin-version", "web-merlin")
 	req.Header.Set("x-merlin-client-type", "web")
 	req.Header.Set("x-merlin-client-version", "1.0.0")
-	req.Header.Set("sec-ch-ua", `"Not_A Brand";v="8", "Chromium";v="120", "Google Chrome";v="120"`)
-	req.Header.Set("sec-ch-ua-mobile", "?0")
-	req.Header.Set("sec-ch-ua-platform", `"macOS"`)
-	req.Header.Set("Sec-Fetch-Dest", "empty")
-	req.Header.Set("Sec-Fetch-Mode", "cors")
-	req.Header.Set("Sec-Fetch-Site", "same-site")
 
 	// 设置Authorization header
 	req.Header.Set("Authorization", refreshToken)
 
 	log.Printf("Sending request to uam.getmerlin.in...")
 	// 发送请求
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := upstream.Client().Do(req)
 	if err != nil {
 		return "", fmt.Errorf("request failed: %v", err)
 	}
@@ -170,7 +185,7 @@ func RefreshAuthToken(refreshToken string) (string, error) {
 	log.Printf("Response from uam.getmerlin.in: %s", string(body))
 
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("refresh token failed: %s", string(body))
+		return "", fmt.Errorf("refresh token failed: %w", upstream.NewStatusError(resp, body))
 	}
 
 	var refreshResp RefreshResponse
@@ -187,7 +202,7 @@ func RefreshAuthToken(refreshToken string) (string, error) {
 	}
 
 	// 更新缓存
-	token := refreshResp.Data.AccessToken
+	token = refreshResp.Data.AccessToken
 	cachedToken = token
 	cachedExpiry = time.Now().Add(refreshInterval)
 
@@ -195,14 +210,45 @@ func RefreshAuthToken(refreshToken string) (string, error) {
 	return token, nil
 }
 
+// ClearTokenCache 清除缓存的token，切换凭据（或测试中切换上游）后调用
+func ClearTokenCache() {
+	tokenLock.Lock()
+	defer tokenLock.Unlock()
+	cachedToken = ""
+	cachedExpiry = time.Time{}
+
+	accountTokensMu.Lock()
+	accountTokens = make(map[string]accountToken)
+	accountTokensMu.Unlock()
+}
+
+// recordRefresh 记录一次token获取的结果以及账号的token状态
+func recordRefresh(id string, source string, err error) {
+	if err != nil {
+		metrics.TokenRefreshFailuresTotal.WithLabelValues(source).Inc()
+		markTokenFailed(id, err)
+		return
+	}
+	metrics.TokenRefreshesTotal.WithLabelValues(source).Inc()
+	markToken(id, time.Now().Add(refreshInterval))
+}
+
 // GenerateToken 获取认证token
 func GenerateToken() (string, error) {
+	return GenerateTokenWithContext(context.Background())
+}
+
+// GenerateTokenWithContext 同 GenerateToken，请求随 ctx 取消
+func GenerateTokenWithContext(ctx context.Context) (token string, err error) {
+	ctx, span := tracing.Start(ctx, "auth.GenerateToken", tracing.AttrAccount.String(AccountID()))
+	defer func() { tracing.End(span, err) }()
+
 	log.Printf("Generating token...")
 	// 优先使用 session token
 	sessionToken := utils.GetEnvOrDefault("MERLIN_SESSION_TOKEN", "")
 	if sessionToken != "" {
 		log.Printf("Using session token")
-		token, err := GetSessionToken(sessionToken)
+		token, err := GetSessionTokenWithContext(ctx, sessionToken)
 		if err == nil {
 			return token, nil
 		}
@@ -213,7 +259,7 @@ func GenerateToken() (string, error) {
 	refreshToken := utils.GetEnvOrDefault("MERLIN_REFRESH_TOKEN", "")
 	if refreshToken != "" {
 		log.Printf("Using refresh token")
-		token, err := RefreshAuthToken(refreshToken)
+		token, err := RefreshAuthTokenWithContext(ctx, refreshToken)
 		if err == nil {
 			return token, nil
 		}
@@ -221,11 +267,69 @@ func GenerateToken() (string, error) {
 	}
 
 	// 最后才尝试使用普通token
-	token := utils.GetEnvOrDefault("MERLIN_TOKEN", "")
+	token = utils.GetEnvOrDefault("MERLIN_TOKEN", "")
 	if token == "" {
-		return "", fmt.Errorf("no valid token found in environment variables")
+		err = ErrNoValidToken
+		markTokenFailed(AccountID(), err)
+		return "", err
 	}
 
 	log.Printf("Using normal token")
+	markToken(AccountID(), time.Time{})
 	return token, nil
 }
+
+// 后台刷新的状态：同一时间只有一个刷新在进行，连续失败时按指数退避
+var (
+	backgroundMu      sync.Mutex
+	backgroundRunning bool
+	backgroundNext    time.Time
+	backgroundBackoff time.Duration
+	backgroundWG      sync.WaitGroup
+)
+
+const (
+	backgroundMinBackoff = time.Second
+	backgroundMaxBackoff = time.Minute
+)
+
+// RefreshInBackground 在后台获取一次token，不阻塞调用方。已有刷新在进行或处于失败退避期间时直接返回，
+// 供就绪检查在没有有效token时使用，避免探针请求直接打到上游
+func RefreshInBackground() {
+	backgroundMu.Lock()
+	if backgroundRunning || time.Now().Before(backgroundNext) {
+		backgroundMu.Unlock()
+		return
+	}
+	backgroundRunning = true
+	backgroundWG.Add(1)
+	backgroundMu.Unlock()
+
+	go func() {
+		defer backgroundWG.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, err := GenerateTokenWithContext(ctx)
+
+		backgroundMu.Lock()
+		defer backgroundMu.Unlock()
+		backgroundRunning = false
+		if err == nil {
+			backgroundBackoff = 0
+			backgroundNext = time.Time{}
+			return
+		}
+		backgroundBackoff = min(max(backgroundBackoff*2, backgroundMinBackoff), backgroundMaxBackoff)
+		backgroundNext = time.Now().Add(backgroundBackoff)
+		log.Printf("Background token refresh failed, next attempt in %v: %v", backgroundBackoff, err)
+	}()
+}
+
+// resetBackgroundRefresh 等待进行中的后台刷新结束并清除退避状态
+func resetBackgroundRefresh() {
+	backgroundWG.Wait()
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	backgroundBackoff = 0
+	backgroundNext = time.Time{}
+}
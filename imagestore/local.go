@@ -0,0 +1,72 @@
+package imagestore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Local 把图片保存到本地目录，每张图片对应 {id}.img 和 {id}.json 两个文件
+type Local struct {
+	dir string
+}
+
+// NewLocal 创建本地存储，目录不存在时自动创建
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create image store dir: %w", err)
+	}
+	return &Local{dir: dir}, nil
+}
+
+func (l *Local) Put(ctx context.Context, meta Metadata, data []byte) error {
+	if !ValidID(meta.ID) {
+		return fmt.Errorf("invalid image id %q", meta.ID)
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// 先写图片再写元数据，Get 只在元数据存在时返回，不会读到写了一半的图片
+	if err := writeFileAtomic(l.path(meta.ID, ".img"), data); err != nil {
+		return err
+	}
+	return writeFileAtomic(l.path(meta.ID, ".json"), metaData)
+}
+
+func (l *Local) Get(ctx context.Context, id string) (Metadata, []byte, error) {
+	var meta Metadata
+	if !ValidID(id) {
+		return meta, nil, ErrNotFound
+	}
+	metaData, err := os.ReadFile(l.path(id, ".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil, ErrNotFound
+	}
+	if err != nil {
+		return meta, nil, err
+	}
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return meta, nil, fmt.Errorf("decode metadata of %s: %w", id, err)
+	}
+	data, err := os.ReadFile(l.path(id, ".img"))
+	if err != nil {
+		return meta, nil, err
+	}
+	return meta, data, nil
+}
+
+func (l *Local) path(id, ext string) string {
+	return filepath.Join(l.dir, id+ext)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
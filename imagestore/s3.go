@@ -0,0 +1,237 @@
+package imagestore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Config S3 兼容存储的连接参数，使用 path-style 地址（{endpoint}/{bucket}/{key}），兼容 MinIO
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// S3 把图片保存到 S3 兼容的存储，每张图片对应 {prefix}{id} 和 {prefix}{id}.json 两个对象
+type S3 struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 创建 S3 存储
+func NewS3(cfg S3Config) (*S3, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, fmt.Errorf("s3 image store requires endpoint, bucket, access key and secret key")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+	return &S3{cfg: cfg, endpoint: endpoint, client: &http.Client{Timeout: 60 * time.Second}}, nil
+}
+
+func (s *S3) Put(ctx context.Context, meta Metadata, data []byte) error {
+	if !ValidID(meta.ID) {
+		return fmt.Errorf("invalid image id %q", meta.ID)
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := s.put(ctx, s.cfg.Prefix+meta.ID, meta.ContentType, data); err != nil {
+		return err
+	}
+	return s.put(ctx, s.cfg.Prefix+meta.ID+".json", "application/json", metaData)
+}
+
+func (s *S3) Get(ctx context.Context, id string) (Metadata, []byte, error) {
+	var meta Metadata
+	if !ValidID(id) {
+		return meta, nil, ErrNotFound
+	}
+	metaData, err := s.get(ctx, s.cfg.Prefix+id+".json")
+	if err != nil {
+		return meta, nil, err
+	}
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return meta, nil, fmt.Errorf("decode metadata of %s: %w", id, err)
+	}
+	data, err := s.get(ctx, s.cfg.Prefix+id)
+	if err != nil {
+		return meta, nil, err
+	}
+	return meta, data, nil
+}
+
+func (s *S3) put(ctx context.Context, key, contentType string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	s.Sign(req, data, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("put %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("put %s: status %d: %s", key, resp.StatusCode, body)
+	}
+	return nil
+}
+
+func (s *S3) get(ctx context.Context, key string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.Sign(req, nil, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("get %s: status %d: %s", key, resp.StatusCode, body)
+}
+
+func (s *S3) objectURL(key string) string {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.cfg.Bucket + "/" + key
+	return u.String()
+}
+
+// unsignedHeaders 不参与签名的请求头：Authorization 是签名本身，User-Agent 和 Expect 可能被代理或传输层改写。
+// 其余在签名时已经设置的请求头（包括 Content-Type）都参与签名，防止被篡改
+var unsignedHeaders = map[string]bool{
+	"authorization": true,
+	"user-agent":    true,
+	"expect":        true,
+}
+
+// Sign 按 AWS Signature Version 4 为请求签名，now 为签名时间。签名之后不能再修改请求头
+func (s *S3) Sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsEscape(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), date)
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// canonicalHeaders 返回按名称排序的规范请求头和签名头列表，名称小写，值去掉多余空白，同名的值用逗号连接
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if unsignedHeaders[name] {
+			continue
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+// canonicalQuery 按参数名排序并编码查询参数
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for name, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, awsEscape(name, true)+"="+awsEscape(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape 按 SigV4 的规则编码：除字母、数字和 -_.~ 外的字节都编码为 %XX，路径中的 / 保留
+func awsEscape(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
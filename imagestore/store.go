@@ -0,0 +1,73 @@
+// Package imagestore 把上游生成的图片保存到本地磁盘或 S3 兼容的存储（如 MinIO），
+// 避免 Merlin CDN 链接过期后图片丢失。每张图片按随机 ID 保存，同时保存生成参数。
+package imagestore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// ErrNotFound 图片不存在
+var ErrNotFound = errors.New("image not found")
+
+// Metadata 图片的生成参数
+type Metadata struct {
+	ID          string    `json:"id"`
+	Prompt      string    `json:"prompt"`
+	Model       string    `json:"model"`
+	Seed        int       `json:"seed"`
+	IID         string    `json:"iid"`
+	SourceURL   string    `json:"source_url"`
+	ContentType string    `json:"content_type"`
+	Size        int       `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Store 图片存储
+type Store interface {
+	// Put 保存图片和元数据，meta.ID 必须由 NewID 生成
+	Put(ctx context.Context, meta Metadata, data []byte) error
+	// Get 读取图片和元数据，不存在时返回 ErrNotFound
+	Get(ctx context.Context, id string) (Metadata, []byte, error)
+}
+
+var idPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewID 生成一个新的图片 ID
+func NewID() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// ValidID 判断 id 是否是 NewID 生成的格式，防止路径穿越
+func ValidID(id string) bool {
+	return idPattern.MatchString(id)
+}
+
+// FromEnv 根据 IMAGE_STORE 创建存储："local" 保存到 IMAGE_STORE_DIR，"s3" 保存到 S3 兼容的存储，
+// 为空时不保存图片，返回 nil
+func FromEnv() (Store, error) {
+	switch kind := utils.GetEnvOrDefault("IMAGE_STORE", ""); kind {
+	case "":
+		return nil, nil
+	case "local":
+		return NewLocal(utils.GetEnvOrDefault("IMAGE_STORE_DIR", "data/images"))
+	case "s3":
+		return NewS3(S3Config{
+			Endpoint:  utils.GetEnvOrDefault("IMAGE_STORE_S3_ENDPOINT", ""),
+			Region:    utils.GetEnvOrDefault("IMAGE_STORE_S3_REGION", "us-east-1"),
+			Bucket:    utils.GetEnvOrDefault("IMAGE_STORE_S3_BUCKET", ""),
+			Prefix:    utils.GetEnvOrDefault("IMAGE_STORE_S3_PREFIX", "images/"),
+			AccessKey: utils.GetEnvOrDefault("IMAGE_STORE_S3_ACCESS_KEY", ""),
+			SecretKey: utils.GetEnvOrDefault("IMAGE_STORE_S3_SECRET_KEY", ""),
+		})
+	default:
+		return nil, fmt.Errorf("unknown IMAGE_STORE %q, expected local or s3", kind)
+	}
+}
@@ -1,17 +1,43 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rubleowen/GetMerlin2Api/api"
 	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/tracing"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
 	"github.com/rubleowen/GetMerlin2Api/utils"
 )
 
 func main() {
 	utils.LoadEnv()
+
+	shutdownTracing, err := tracing.Init(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to init tracing: %v", err)
+	}
+
+	if err := api.InitImageStore(); err != nil {
+		log.Fatalf("Failed to init image store: %v", err)
+	}
+
+	if err := upstream.Init(); err != nil {
+		log.Fatalf("Failed to init upstream client: %v", err)
+	}
+
+	api.InitImageCache()
+	stopImageJobs := api.StartImageJobs()
+
 	// 生成一个token用于测试
 	token, err := auth.GenerateToken()
 	if err != nil {
@@ -20,16 +46,72 @@ func main() {
 	// 打印token的前100个字符，避免日志过长
 	fmt.Printf("Token prefix: %s...\n", token[:100])
 
-	// 注册路由
-	http.HandleFunc("/", api.HandleChat)
-	http.HandleFunc("/v1/chat/completions", api.HandleChat)
-	http.HandleFunc("/v1/images/generations", api.HandleImageGenerations)
-	http.HandleFunc("/web/v2/image-generation", api.HandleImageGeneration)
+	// 预热上游连接
+	if utils.GetEnvOrDefault("MERLIN_PREWARM", "true") == "true" {
+		go upstream.Prewarm(context.Background(), upstream.Client(),
+			upstream.SessionURL()+"/",
+			upstream.UAMURL()+"/",
+			upstream.ArcaneURL()+"/",
+		)
+	}
+
+	// 注册路由，指标标签和 span 名都使用注册时的路径
+	route := func(pattern string, handler http.HandlerFunc) {
+		http.Handle(pattern, tracing.Handler(pattern, metrics.Instrument(pattern, handler)))
+	}
+	route("/", api.HandleChat)
+	route("/v1/chat/completions", api.HandleChat)
+	route("/v1/images/generations", api.HandleImageGenerations)
+	route("/v1/images/jobs", api.HandleImageJobs)
+	route("/v1/images/jobs/", api.HandleImageJobs)
+	route("/v1/images/edits", api.HandleImageEdits)
+	route("/v1/images/variations", api.HandleImageVariations)
+	route("/web/v2/image-generation", api.HandleImageGeneration)
+	route("/files/", api.HandleFiles)
+	// 指标和健康检查接口不记录 span
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", api.HandleHealthz)
+	http.HandleFunc("/readyz", api.HandleReadyz)
+	http.Handle("/debug/status", tracing.Handler("/debug/status", http.HandlerFunc(api.HandleDebugStatus)))
 
 	// 启动服务器
-	port := "8081"
-	fmt.Printf("Server starting on port %s...\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	port := utils.GetEnvOrDefault("PORT", "8081")
+	drain := api.NewDrain()
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: api.WithDrain(drain, http.DefaultServeMux),
+	}
+
+	// 等待退出信号
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		fmt.Printf("Server starting on port %s...\n", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	// HTTP 请求和已提交的图片任务共用同一个排空期限，同时进行
+	drainTimeout := utils.GetEnvDuration("DRAIN_TIMEOUT", 30*time.Second)
+	log.Printf("Shutting down, draining in-flight requests and image jobs for up to %v...", drainTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), drainTimeout)
+	jobsStopped := make(chan struct{})
+	go func() {
+		defer close(jobsStopped)
+		stopImageJobs(drainCtx)
+	}()
+	drain.Shutdown(drainCtx, server)
+	<-jobsStopped
+	cancelDrain()
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Printf("Failed to flush traces: %v", err)
 	}
 }
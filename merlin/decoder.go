@@ -0,0 +1,55 @@
+package merlin
+
+import (
+	"io"
+	"log"
+
+	"github.com/rubleowen/GetMerlin2Api/sse"
+)
+
+// Decoder 从上游响应体中逐个读取 Merlin 事件。
+// 无法解析或无法识别的事件会记录日志，并以 UnknownEvent 返回
+type Decoder struct {
+	sse     *sse.Decoder
+	pending []Event
+	event   Event
+}
+
+// NewDecoder 创建解码器
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{sse: sse.NewDecoder(r)}
+}
+
+// Next 读取下一个事件，没有更多事件或出错时返回 false，错误通过 Err 获取
+func (d *Decoder) Next() bool {
+	for len(d.pending) == 0 {
+		if !d.sse.Next() {
+			return false
+		}
+		raw := d.sse.Event()
+		events, err := Parse(raw.Event, raw.Data)
+		if err != nil {
+			log.Printf("Warning: %v, data: %s", err, raw.Data)
+			events = []Event{UnknownEvent{Name: raw.Event, Data: raw.Data}}
+		}
+		for _, event := range events {
+			if unknown, ok := event.(UnknownEvent); ok && err == nil {
+				log.Printf("Warning: unknown Merlin event %q: %s", unknown.Name, unknown.Data)
+			}
+		}
+		d.pending = events
+	}
+
+	d.event, d.pending = d.pending[0], d.pending[1:]
+	return true
+}
+
+// Event 返回 Next 读到的事件
+func (d *Decoder) Event() Event {
+	return d.event
+}
+
+// Err 返回读取过程中的错误，正常结束时为 nil
+func (d *Decoder) Err() error {
+	return d.sse.Err()
+}
@@ -0,0 +1,262 @@
+// Package merlin 定义 Merlin 上游 SSE 事件的类型化模型。
+// thread/unified（聊天）和 wallflower/unified-generation（图片）的响应都通过 Decoder 解析，
+// 一个上游数据帧可能拆分成多个事件，例如同时包含内容和附件。
+package merlin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Event 所有 Merlin 事件都实现该接口，使用 type switch 区分
+type Event interface {
+	isEvent()
+}
+
+// ContentEvent 一段聊天回复文本
+type ContentEvent struct {
+	Text string
+}
+
+// DoneEvent 上游表示回复结束（eventType DONE 或 [DONE]）
+type DoneEvent struct{}
+
+// ErrorEvent 上游在流中返回的错误
+type ErrorEvent struct {
+	Type    string
+	Code    string
+	Message string
+}
+
+// AttachmentEvent 回复中携带的附件，例如生成的图片
+type AttachmentEvent struct {
+	Attachments []Attachment
+}
+
+// CitationEvent 联网搜索时引用的来源
+type CitationEvent struct {
+	Citations []Citation
+}
+
+// UsageEvent 上游统计的 token 用量
+type UsageEvent struct {
+	Usage Usage
+}
+
+// ProgressEvent wallflower 生成进度，Percent 为 0-100，未知时为 -1
+type ProgressEvent struct {
+	Status  string
+	Percent float64
+}
+
+// ImagesEvent wallflower 生成完成的图片
+type ImagesEvent struct {
+	Variations []Variation
+}
+
+// UnknownEvent 无法识别的事件，保留原始数据便于排查
+type UnknownEvent struct {
+	Name string
+	Data string
+}
+
+func (ContentEvent) isEvent()    {}
+func (DoneEvent) isEvent()       {}
+func (ErrorEvent) isEvent()      {}
+func (AttachmentEvent) isEvent() {}
+func (CitationEvent) isEvent()   {}
+func (UsageEvent) isEvent()      {}
+func (ProgressEvent) isEvent()   {}
+func (ImagesEvent) isEvent()     {}
+func (UnknownEvent) isEvent()    {}
+
+// Error 实现 error 接口，方便直接作为上游错误返回
+func (e ErrorEvent) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("merlin error %s: %s", e.Type, e.Message)
+	}
+	return "merlin error: " + e.Message
+}
+
+type Attachment struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	Name string `json:"name,omitempty"`
+}
+
+type Citation struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+	TotalTokens      int `json:"totalTokens"`
+}
+
+type Variation struct {
+	URL  string `json:"url"`
+	IID  string `json:"iid"`
+	Seed int    `json:"seed"`
+}
+
+// 已知的聊天 eventType，其他值会作为 UnknownEvent 返回
+const (
+	eventTypeChunk = "CHUNK"
+	eventTypeDone  = "DONE"
+)
+
+// frame 上游数据帧的线上格式，聊天和图片接口共用
+type frame struct {
+	Status string `json:"status"`
+	Data   *struct {
+		Content     string          `json:"content"`
+		EventType   string          `json:"eventType"`
+		Error       json.RawMessage `json:"error"`
+		Attachments []Attachment    `json:"attachments"`
+		Citations   []Citation      `json:"citations"`
+		Usage       *Usage          `json:"usage"`
+		Message     *struct {
+			Attachments []Attachment `json:"attachments"`
+			Citations   []Citation   `json:"citations"`
+		} `json:"message"`
+	} `json:"data"`
+	Error    json.RawMessage `json:"error"`
+	Message  string          `json:"message"`
+	Progress *float64        `json:"progress"`
+	Payload  []struct {
+		Status     string      `json:"status"`
+		Progress   *float64    `json:"progress"`
+		Variations []Variation `json:"variations"`
+	} `json:"payload"`
+}
+
+// wallflowerStatuses wallflower 在生成完成前只带状态的帧
+var wallflowerStatuses = map[string]bool{
+	"queued":     true,
+	"pending":    true,
+	"processing": true,
+	"generating": true,
+}
+
+// Parse 把一个 SSE 事件的 data 解析为一个或多个 Merlin 事件，name 是 SSE 的 event 字段
+func Parse(name, data string) ([]Event, error) {
+	if data == "[DONE]" {
+		return []Event{DoneEvent{}}, nil
+	}
+
+	var f frame
+	if err := json.Unmarshal([]byte(data), &f); err != nil {
+		return nil, fmt.Errorf("parse merlin event failed: %v", err)
+	}
+
+	if e, ok := f.errorEvent(); ok {
+		return []Event{e}, nil
+	}
+
+	var events []Event
+	known := false
+
+	if d := f.Data; d != nil {
+		switch d.EventType {
+		case eventTypeChunk, eventTypeDone:
+			known = true
+		case "":
+			known = f.Status == "success"
+		}
+
+		if d.Content != "" && f.Status != "system" {
+			events = append(events, ContentEvent{Text: d.Content})
+		}
+		attachments := d.Attachments
+		citations := d.Citations
+		if d.Message != nil {
+			attachments = append(attachments, d.Message.Attachments...)
+			citations = append(citations, d.Message.Citations...)
+		}
+		if len(attachments) > 0 {
+			events = append(events, AttachmentEvent{Attachments: attachments})
+		}
+		if len(citations) > 0 {
+			events = append(events, CitationEvent{Citations: citations})
+		}
+		if d.Usage != nil {
+			events = append(events, UsageEvent{Usage: *d.Usage})
+		}
+	}
+
+	var variations []Variation
+	for _, p := range f.Payload {
+		known = true
+		if p.Progress != nil {
+			events = append(events, ProgressEvent{Status: p.Status, Percent: *p.Progress})
+		} else if p.Status != "" && len(p.Variations) == 0 {
+			events = append(events, ProgressEvent{Status: p.Status, Percent: -1})
+		}
+		for _, v := range p.Variations {
+			if v.URL != "" {
+				variations = append(variations, v)
+			}
+		}
+	}
+	if f.Progress != nil {
+		known = true
+		events = append(events, ProgressEvent{Status: f.Status, Percent: *f.Progress})
+	} else if f.Data == nil && f.Payload == nil && wallflowerStatuses[f.Status] {
+		// 排队等只有状态、没有进度的帧
+		known = true
+		events = append(events, ProgressEvent{Status: f.Status, Percent: -1})
+	}
+	if len(variations) > 0 {
+		events = append(events, ImagesEvent{Variations: variations})
+	}
+
+	if f.Data != nil && f.Data.EventType == eventTypeDone {
+		events = append(events, DoneEvent{})
+	}
+
+	if !known {
+		events = append(events, UnknownEvent{Name: name, Data: data})
+	}
+	return events, nil
+}
+
+// errorEvent 上游错误可能是顶层 error 对象、字符串，也可能放在 data.error 中
+func (f *frame) errorEvent() (ErrorEvent, bool) {
+	raw := f.Error
+	if len(bytes.TrimSpace(raw)) == 0 || string(raw) == "null" {
+		if f.Data != nil {
+			raw = f.Data.Error
+		}
+	}
+
+	if len(bytes.TrimSpace(raw)) == 0 || string(raw) == "null" {
+		if f.Status == "error" {
+			return ErrorEvent{Message: f.Message}, true
+		}
+		return ErrorEvent{}, false
+	}
+
+	var message string
+	if err := json.Unmarshal(raw, &message); err == nil {
+		if message == "" {
+			return ErrorEvent{}, false
+		}
+		return ErrorEvent{Message: message}, true
+	}
+
+	var obj struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return ErrorEvent{Message: string(raw)}, true
+	}
+	if obj.Message == "" {
+		obj.Message = f.Message
+	}
+	return ErrorEvent{Type: obj.Type, Code: obj.Code, Message: obj.Message}, true
+}
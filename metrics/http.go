@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ctxKey struct{}
+
+// requestInfo 保存处理过程中才能确定的标签，由 handler 通过 ctx 填写
+type requestInfo struct {
+	mu         sync.Mutex
+	route      string
+	model      string
+	start      time.Time
+	firstToken bool
+}
+
+func fromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(ctxKey{}).(*requestInfo)
+	return info
+}
+
+// SetModel 记录当前请求使用的模型，未知模型记为 other
+func SetModel(ctx context.Context, model string) {
+	if info := fromContext(ctx); info != nil {
+		info.mu.Lock()
+		info.model = ModelLabel(model)
+		info.mu.Unlock()
+	}
+}
+
+// ObserveFirstToken 在第一个内容块发送时记录首 token 延迟，同一请求只记录一次
+func ObserveFirstToken(ctx context.Context) {
+	info := fromContext(ctx)
+	if info == nil {
+		return
+	}
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	if info.firstToken {
+		return
+	}
+	info.firstToken = true
+	TimeToFirstToken.WithLabelValues(info.model).Observe(time.Since(info.start).Seconds())
+}
+
+func (info *requestInfo) labels() (string, string) {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.route, info.model
+}
+
+// Instrument 为 handler 记录请求数、延迟和 SSE 输出量，route 使用注册时的路径避免标签爆炸
+func Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info := &requestInfo{route: route, start: time.Now()}
+		rec := &recorder{ResponseWriter: w, info: info, status: http.StatusOK}
+
+		next(rec, r.WithContext(context.WithValue(r.Context(), ctxKey{}, info)))
+
+		_, model := info.labels()
+		status := strconv.Itoa(rec.status)
+		RequestsTotal.WithLabelValues(route, model, status).Inc()
+		RequestDuration.WithLabelValues(route, model, status).Observe(time.Since(info.start).Seconds())
+	}
+}
+
+// recorder 记录状态码，并把 SSE 的每次写入计为一个事件
+type recorder struct {
+	http.ResponseWriter
+	info   *requestInfo
+	status int
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(p)
+	if strings.HasPrefix(r.Header().Get("Content-Type"), "text/event-stream") {
+		route, model := r.info.labels()
+		if bytes.HasPrefix(p, []byte("data: ")) {
+			SSEChunksTotal.WithLabelValues(route, model).Inc()
+		}
+		SSEBytesTotal.WithLabelValues(route, model).Add(float64(n))
+	}
+	return n, err
+}
+
+func (r *recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap 让 http.ResponseController 能访问底层的 ResponseWriter
+func (r *recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
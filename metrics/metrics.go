@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "merlin2api"
+
+var (
+	// 入站请求
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Inbound HTTP requests by route, model and status code.",
+	}, []string{"route", "model", "status"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Inbound HTTP request latency, including the full SSE stream.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120, 300},
+	}, []string{"route", "model", "status"})
+
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from request arrival to the first content chunk sent to the client.",
+		Buckets:   []float64{0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120},
+	}, []string{"model"})
+
+	// SSE 输出
+	SSEChunksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sse_chunks_total",
+		Help:      "SSE events written to clients.",
+	}, []string{"route", "model"})
+
+	SSEBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sse_bytes_total",
+		Help:      "Bytes of SSE events written to clients.",
+	}, []string{"route", "model"})
+
+	// 上游
+	UpstreamResponsesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_responses_total",
+		Help:      "Responses from Merlin by host and status code; code is \"error\" when no response was received.",
+	}, []string{"host", "code"})
+
+	TokenRefreshesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refreshes_total",
+		Help:      "Access token acquisitions by credential source.",
+	}, []string{"source"})
+
+	TokenRefreshFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_refresh_failures_total",
+		Help:      "Failed access token acquisitions by credential source.",
+	}, []string{"source"})
+
+	ImageGenerationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_generations_total",
+		Help:      "Image generation requests by model and result.",
+	}, []string{"model", "result"})
+
+	ImagesGeneratedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_generated_total",
+		Help:      "Individual images returned by Merlin.",
+	}, []string{"model"})
+
+	ImageCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_cache_requests_total",
+		Help:      "Image result cache lookups by result (hit, miss or bypass).",
+	}, []string{"result"})
+
+	ImageJobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_jobs_total",
+		Help:      "Asynchronous image jobs by final status (succeeded, failed or rejected).",
+	}, []string{"status"})
+
+	ImageJobsQueued = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "image_jobs_queued",
+		Help:      "Asynchronous image jobs waiting for a worker.",
+	})
+
+	ImageJobWebhooksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "image_job_webhooks_total",
+		Help:      "Image job webhook deliveries by result (delivered or failed).",
+	}, []string{"result"})
+
+	TokensTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Estimated chat tokens by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+
+	// 账号池
+	AccountInflight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "account_inflight_requests",
+		Help:      "Upstream requests currently in flight per account.",
+	}, []string{"account"})
+
+	AccountTokenValid = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "account_token_valid",
+		Help:      "Whether the account currently holds a usable access token (1) or not (0).",
+	}, []string{"account"})
+
+	AccountTokenExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "account_token_expiry_timestamp_seconds",
+		Help:      "Unix time at which the account's cached access token will be refreshed.",
+	}, []string{"account"})
+)
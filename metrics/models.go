@@ -0,0 +1,39 @@
+package metrics
+
+// OtherModel 不在 knownModels 中的模型使用的标签值
+const OtherModel = "other"
+
+// knownModels 可以作为 model 标签的模型名。模型名来自请求，原样作为标签会让时间序列数量随客户端输入无限增长，
+// 新增对外支持的模型时需要加到这里
+var knownModels = map[string]bool{
+	// 聊天
+	"gpt-4o":            true,
+	"gpt-4o-mini":       true,
+	"gpt-4o-64k-output": true,
+	"gpt-4.1":           true,
+	"gpt-4.1-mini":      true,
+	"o1":                true,
+	"o1-mini":           true,
+	"o3-mini":           true,
+	"claude-3-haiku":    true,
+	"claude-3.5-sonnet": true,
+	"claude-3.7-sonnet": true,
+	"gemini-1.5-pro":    true,
+	"gemini-2.0-flash":  true,
+	"deepseek-chat":     true,
+	"deepseek-r1":       true,
+	// 图片
+	"flux-1.1-pro": true,
+	"recraft-v3":   true,
+	"dall-e-2":     true,
+	"dall-e-3":     true,
+	"gpt-image-1":  true,
+}
+
+// ModelLabel 把请求中的模型名转换为取值有限的标签，未知模型记为 other
+func ModelLabel(model string) string {
+	if knownModels[model] {
+		return model
+	}
+	return OtherModel
+}
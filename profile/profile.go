@@ -0,0 +1,159 @@
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// Profile 描述一个被模拟的浏览器客户端，所有上游请求的浏览器特征头都由它生成
+type Profile struct {
+	Name           string `json:"name"`
+	Brand          string `json:"brand"`
+	Version        string `json:"version"`
+	GreaseBrand    string `json:"greaseBrand"`
+	GreaseVersion  string `json:"greaseVersion"`
+	Platform       string `json:"platform"`
+	OSToken        string `json:"osToken"`
+	Mobile         bool   `json:"mobile"`
+	AcceptLanguage string `json:"acceptLanguage"`
+	MerlinVersion  string `json:"merlinVersion"`
+}
+
+// Config 是头部配置文件的结构。Version 只是配置本身的版本标签，加载时打印到日志，不影响任何请求头
+type Config struct {
+	Version  string            `json:"version"`
+	Default  string            `json:"default"`
+	Profiles []Profile         `json:"profiles"`
+	Bindings map[string]string `json:"bindings"`
+}
+
+// 内置默认配置。更新被模拟的浏览器时修改 Profiles 中的 Version（生成 User-Agent 和 sec-ch-ua），
+// 必要时同时修改 GreaseVersion、OSToken；MerlinVersion 决定 X-Merlin-Version。修改后顺带更新 Config.Version 标签
+var builtinConfig = Config{
+	Version: "2024-12",
+	Default: "chrome-macos",
+	Profiles: []Profile{
+		{
+			Name:           "chrome-macos",
+			Brand:          "Google Chrome",
+			Version:        "131",
+			GreaseBrand:    "Not_A Brand",
+			GreaseVersion:  "24",
+			Platform:       "macOS",
+			OSToken:        "Macintosh; Intel Mac OS X 10_15_7",
+			AcceptLanguage: "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7",
+			MerlinVersion:  "web-merlin",
+		},
+	},
+}
+
+var (
+	loadOnce sync.Once
+	config   atomic.Pointer[Config]
+)
+
+// UserAgent 根据浏览器版本生成 User-Agent
+func (p *Profile) UserAgent() string {
+	return fmt.Sprintf("Mozilla/5.0 (%s) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/%s.0.0.0 Safari/537.36", p.OSToken, p.Version)
+}
+
+// SecChUA 根据浏览器版本生成 sec-ch-ua
+func (p *Profile) SecChUA() string {
+	return fmt.Sprintf(`"%s";v="%s", "Chromium";v="%s", "%s";v="%s"`, p.Brand, p.Version, p.Version, p.GreaseBrand, p.GreaseVersion)
+}
+
+// Apply 将浏览器特征头写入请求头，Accept 等与接口相关的头由调用方设置
+func (p *Profile) Apply(h http.Header) {
+	mobile := "?0"
+	if p.Mobile {
+		mobile = "?1"
+	}
+
+	h.Set("Accept-Language", p.AcceptLanguage)
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Origin", "https://www.getmerlin.in")
+	h.Set("Pragma", "no-cache")
+	h.Set("Priority", "u=1, i")
+	h.Set("Referer", "https://www.getmerlin.in/")
+	h.Set("Sec-Ch-Ua", p.SecChUA())
+	h.Set("Sec-Ch-Ua-Mobile", mobile)
+	h.Set("Sec-Ch-Ua-Platform", fmt.Sprintf(`"%s"`, p.Platform))
+	h.Set("Sec-Fetch-Dest", "empty")
+	h.Set("Sec-Fetch-Mode", "cors")
+	h.Set("Sec-Fetch-Site", "same-site")
+	h.Set("User-Agent", p.UserAgent())
+	h.Set("X-Merlin-Version", p.MerlinVersion)
+}
+
+// LoadConfig 从 MERLIN_HEADER_PROFILES 指定的 JSON 文件读取配置，未设置时返回内置配置
+func LoadConfig(path string) (Config, error) {
+	if path == "" {
+		return builtinConfig, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("read header profiles failed: %v", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return Config{}, fmt.Errorf("unmarshal header profiles failed: %v", err)
+	}
+	if len(cfg.Profiles) == 0 {
+		return Config{}, fmt.Errorf("no profiles defined in %s", path)
+	}
+	return cfg, nil
+}
+
+func current() *Config {
+	loadOnce.Do(func() {
+		cfg, err := LoadConfig(utils.GetEnvOrDefault("MERLIN_HEADER_PROFILES", ""))
+		if err != nil {
+			log.Printf("Warning: %v, using builtin header profiles", err)
+			cfg = builtinConfig
+		}
+		config.Store(&cfg)
+		log.Printf("Loaded header profiles version %s (%d profiles)", cfg.Version, len(cfg.Profiles))
+	})
+	return config.Load()
+}
+
+// SetConfig 替换当前使用的头部配置，返回的函数用于恢复原配置
+func SetConfig(cfg Config) func() {
+	previous := current()
+	config.Store(&cfg)
+	return func() { config.Store(previous) }
+}
+
+// Select 为账号选择浏览器配置：优先使用显式绑定，否则按账号ID哈希固定选择一个，保证同一账号始终表现为同一个浏览器
+func (c *Config) Select(accountID string) *Profile {
+	name, ok := c.Bindings[accountID]
+	if !ok && accountID == "" {
+		name = c.Default
+	}
+	if name != "" {
+		for i := range c.Profiles {
+			if c.Profiles[i].Name == name {
+				return &c.Profiles[i]
+			}
+		}
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(accountID))
+	return &c.Profiles[h.Sum32()%uint32(len(c.Profiles))]
+}
+
+// ForAccount 返回账号绑定的浏览器配置
+func ForAccount(accountID string) *Profile {
+	return current().Select(accountID)
+}
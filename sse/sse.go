@@ -0,0 +1,195 @@
+// Package sse 实现 Server-Sent Events 的解码和编码（WHATWG HTML 规范 9.2 节）。
+// 解码不限制单个事件的大小，支持 event、data、id、retry 字段、多行 data 以及注释行。
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event 一个完整的 SSE 事件
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// Decoder 以类似 bufio.Scanner 的方式逐个读取事件
+type Decoder struct {
+	r           *bufio.Reader
+	line        bytes.Buffer
+	data        bytes.Buffer
+	eventType   string
+	lastEventID string
+	retry       time.Duration
+	hasData     bool
+	event       Event
+	err         error
+}
+
+// NewDecoder 创建解码器
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next 读取下一个事件，没有更多事件或出错时返回 false，错误通过 Err 获取
+func (d *Decoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			if err != io.EOF {
+				d.err = err
+				return false
+			}
+			// 规范要求丢弃未以空行结束的事件，但上游可能直接关闭连接，这里仍然分发已收到的数据
+			if line != "" {
+				d.processLine(line)
+			}
+			if d.hasData {
+				d.dispatch()
+				return true
+			}
+			d.err = io.EOF
+			return false
+		}
+
+		if line == "" {
+			if d.hasData {
+				d.dispatch()
+				return true
+			}
+			d.eventType = ""
+			continue
+		}
+		d.processLine(line)
+	}
+}
+
+// Event 返回 Next 读到的事件
+func (d *Decoder) Event() Event {
+	return d.event
+}
+
+// Err 返回读取过程中的错误，正常结束时为 nil
+func (d *Decoder) Err() error {
+	if d.err == io.EOF {
+		return nil
+	}
+	return d.err
+}
+
+// LastEventID 返回最近一次收到的事件 id
+func (d *Decoder) LastEventID() string {
+	return d.lastEventID
+}
+
+// readLine 读取一行，行尾可以是 \r\n、\n 或 \r
+func (d *Decoder) readLine() (string, error) {
+	d.line.Reset()
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return d.line.String(), err
+		}
+		switch b {
+		case '\n':
+			return d.line.String(), nil
+		case '\r':
+			if next, err := d.r.Peek(1); err == nil && next[0] == '\n' {
+				d.r.ReadByte()
+			}
+			return d.line.String(), nil
+		default:
+			d.line.WriteByte(b)
+		}
+	}
+}
+
+func (d *Decoder) processLine(line string) {
+	// 冒号开头的是注释
+	if strings.HasPrefix(line, ":") {
+		return
+	}
+
+	field, value, found := strings.Cut(line, ":")
+	if found {
+		value = strings.TrimPrefix(value, " ")
+	}
+
+	switch field {
+	case "event":
+		d.eventType = value
+	case "data":
+		if d.hasData {
+			d.data.WriteByte('\n')
+		}
+		d.data.WriteString(value)
+		d.hasData = true
+	case "id":
+		if !strings.ContainsRune(value, 0) {
+			d.lastEventID = value
+		}
+	case "retry":
+		if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+			d.retry = time.Duration(ms) * time.Millisecond
+		}
+	}
+}
+
+func (d *Decoder) dispatch() {
+	eventType := d.eventType
+	if eventType == "" {
+		eventType = "message"
+	}
+	d.event = Event{
+		ID:    d.lastEventID,
+		Event: eventType,
+		Data:  d.data.String(),
+		Retry: d.retry,
+	}
+	d.data.Reset()
+	d.hasData = false
+	d.eventType = ""
+}
+
+// Write 把事件编码后写入 w，多行 data 拆成多个 data 字段
+func Write(w io.Writer, e Event) error {
+	if strings.ContainsAny(e.Event+e.ID, "\r\n") {
+		return fmt.Errorf("sse: event name and id must not contain newlines")
+	}
+
+	var buf bytes.Buffer
+	if e.ID != "" {
+		fmt.Fprintf(&buf, "id: %s\n", e.ID)
+	}
+	if e.Event != "" && e.Event != "message" {
+		fmt.Fprintf(&buf, "event: %s\n", e.Event)
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&buf, "retry: %d\n", e.Retry.Milliseconds())
+	}
+	data := strings.ReplaceAll(strings.ReplaceAll(e.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// WriteComment 写入一个注释行，客户端会忽略它，常用作心跳
+func WriteComment(w io.Writer, comment string) error {
+	_, err := fmt.Fprintf(w, ": %s\n\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(comment))
+	return err
+}
@@ -4,14 +4,46 @@ import (
 	"bytes"
 	"encoding/json"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
 )
 
+// postChat 直接调用 handler，请求会发往假上游
+func postChat(t *testing.T, body map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewBuffer(jsonData))
+	api.HandleChat(rec, req)
+	return rec
+}
+
+// streamData 返回 SSE 响应中所有 data 行的内容
+func streamData(body string) []string {
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "data: ") {
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+	return data
+}
+
 func TestChatCompletion(t *testing.T) {
-	url := "http://localhost:8080/v1/chat/completions"
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("你好，"), fakemerlin.Content("我是Merlin"), fakemerlin.Done())
 
 	// 准备请求数据
-	requestBody := map[string]interface{}{
+	rec := postChat(t, map[string]interface{}{
 		"messages": []map[string]string{
 			{
 				"role":    "user",
@@ -20,28 +52,17 @@ func TestChatCompletion(t *testing.T) {
 		},
 		"stream": false,
 		"model":  "gpt-3.5-turbo",
-	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		t.Fatalf("Failed to marshal request body: %v", err)
-	}
-
-	// 发送请求
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		t.Fatalf("Failed to send request: %v", err)
-	}
-	defer resp.Body.Close()
+	})
 
 	// 检查响应状态码
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("Expected status OK; got %v", resp.Status)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status OK; got %v: %s", rec.Code, rec.Body.String())
 	}
 
 	// 解析响应
+	body := rec.Body.String()
 	var response map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
 
@@ -49,7 +70,163 @@ func TestChatCompletion(t *testing.T) {
 	if response["choices"] == nil {
 		t.Error("Response does not contain 'choices' field")
 	}
+	var completion api.ChatCompletion
+	if err := json.Unmarshal([]byte(body), &completion); err != nil {
+		t.Fatalf("Failed to decode completion: %v", err)
+	}
+	if !strings.HasPrefix(completion.ID, "chatcmpl-") || completion.Object != "chat.completion" || len(completion.Choices) != 1 {
+		t.Fatalf("unexpected completion %+v", completion)
+	}
+	if message := completion.Choices[0].Message; message.Role != "assistant" || !strings.Contains(message.Content, "你好，我是Merlin") {
+		t.Errorf("Response does not contain the upstream content in message: %+v", message)
+	}
+	if strings.Contains(body, `"delta"`) {
+		t.Errorf("Non-streaming responses should use message, not delta: %s", body)
+	}
+	// images 扩展字段只用于画图模型，文本回复与 OpenAI 完全一致
+	if strings.Contains(body, `"images"`) {
+		t.Errorf("text completions must not carry the images extension: %s", body)
+	}
+
+	// 检查发给上游的请求
+	var merlinReq api.MerlinRequest
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/thread/unified" {
+			json.Unmarshal(r.Body, &merlinReq)
+		}
+	}
+	if merlinReq.Message.Content != "你好，请做个自我介绍" || merlinReq.Model != "gpt-3.5-turbo" {
+		t.Errorf("Unexpected upstream request: %+v", merlinReq)
+	}
+}
+
+func TestChatCompletionStream(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("Hello"), fakemerlin.Content(", world"), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected SSE response, got %s: %s", ct, rec.Body.String())
+	}
+
+	data := streamData(rec.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("Stream must end with [DONE]: %v", data)
+	}
+
+	var content strings.Builder
+	for _, d := range data[:len(data)-1] {
+		var chunk api.OpenAIStreamResponse
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("Invalid chunk %s: %v", d, err)
+		}
+		if chunk.Object != "chat.completion.chunk" {
+			t.Errorf("Unexpected object %s", chunk.Object)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+		}
+	}
+	if content.String() != "Hello, world" {
+		t.Errorf("Expected streamed content %q, got %q", "Hello, world", content.String())
+	}
+}
+
+func TestImageModelThroughChat(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "一只可爱的猫"}},
+		"stream":   true,
+		"model":    "flux-1.1-pro",
+	})
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Image models reached through chat should stream, got %s", ct)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "![image](https://cdn.example.com/image-0.png)") || !strings.Contains(body, "![image](https://cdn.example.com/image-1.png)") {
+		t.Errorf("Expected both image URLs in response: %s", body)
+	}
+}
+
+func TestImageModelThroughChatNonStreaming(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "一只可爱的猫"}},
+		"stream":   false,
+		"model":    "recraft-v3",
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response without stream, got %s", ct)
+	}
+	var resp api.ChatCompletion
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	if !strings.HasPrefix(resp.ID, "chatcmpl-") || resp.Object != "chat.completion" || resp.Model != "recraft-v3" || len(resp.Choices) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	choice := resp.Choices[0]
+	want := "生成的图片:\n1. ![image](https://cdn.example.com/image-0.png)\n2. ![image](https://cdn.example.com/image-1.png)"
+	if choice.Message.Role != "assistant" || choice.Message.Content != want || choice.FinishReason != "stop" {
+		t.Errorf("unexpected choice %+v", choice)
+	}
+	if len(choice.Message.Images) != 2 || choice.Message.Images[0].Type != "image_url" || choice.Message.Images[1].ImageURL.URL != "https://cdn.example.com/image-1.png" {
+		t.Errorf("unexpected image parts %+v", choice.Message.Images)
+	}
+	if resp.Usage.PromptTokens == 0 || resp.Usage.TotalTokens != resp.Usage.PromptTokens+resp.Usage.CompletionTokens {
+		t.Errorf("unexpected usage %+v", resp.Usage)
+	}
+}
+
+func TestImageModelThroughChatNonStreamingError(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptImage(fakemerlin.Error("CONTENT_POLICY", "prompt was flagged"))
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "一只可爱的猫"}},
+		"model":    "flux-1.1-pro",
+	})
 
-	// 打印响应内容以供查看
-	t.Logf("Response: %+v", response)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeError(t, rec.Body.String()); resp.Error.Code != "content_policy_violation" {
+		t.Errorf("unexpected error %+v", resp.Error)
+	}
+}
+
+func TestChatUpstreamUnauthorized(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.Fail("/", http.StatusUnauthorized, `{}`)
+	fake.Fail("/session/get", http.StatusUnauthorized, `{}`)
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 before the stream starts, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "Hello from fake Merlin") {
+		t.Errorf("Content should not be streamed when no credential works")
+	}
 }
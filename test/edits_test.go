@@ -0,0 +1,162 @@
+package test
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// postMultipart 以 multipart 表单调用图片编辑或变体 handler，files 的键是字段名，值是文件名和内容
+func postMultipart(t *testing.T, handler http.HandlerFunc, path string, fields map[string]string, files map[string]map[string][]byte) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range fields {
+		form.WriteField(name, value)
+	}
+	for field, named := range files {
+		for filename, data := range named {
+			part, err := form.CreateFormFile(field, filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part.Write(data)
+		}
+	}
+	form.Close()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	handler(rec, req)
+	return rec
+}
+
+func uploadRequests(fake *fakemerlin.Server) int {
+	count := 0
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/wallflower/upload" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestImageEdit(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	data := pngImage(t)
+
+	rec := postMultipart(t, api.HandleImageEdits, "/v1/images/edits",
+		map[string]string{"prompt": "add a hat", "model": "flux-1.1-pro", "size": "1792x1024"},
+		map[string]map[string][]byte{"image": {"cat.png": data}, "mask": {"mask.png": data}})
+
+	images := decodeImages(t, rec)
+	if len(images) != 2 || images[0].URL != "https://cdn.example.com/image-0.png" || images[0].RevisedPrompt != "add a hat" {
+		t.Errorf("unexpected images %+v", images)
+	}
+	if n := uploadRequests(fake); n != 2 {
+		t.Errorf("expected the image and mask to be uploaded, got %d uploads", n)
+	}
+
+	req := wallflowerRequest(t, fake)
+	if req.Feature.Type != "EDIT" || req.Prompt != "add a hat" || req.Feature.ModelConfig.AspectRatio != "16:9" {
+		t.Errorf("unexpected wallflower request %+v", req)
+	}
+	if len(req.Attachments) != 2 ||
+		req.Attachments[0].Type != "IMAGE" || req.Attachments[0].URL != fake.URL+"/files/uploads/cat.png" ||
+		req.Attachments[1].Type != "MASK" || req.Attachments[1].URL != fake.URL+"/files/uploads/mask.png" {
+		t.Errorf("unexpected attachments %+v", req.Attachments)
+	}
+}
+
+func TestImageVariation(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postMultipart(t, api.HandleImageVariations, "/v1/images/variations",
+		map[string]string{"n": "3", "seed": "7", "style": "Anime"},
+		map[string]map[string][]byte{"image": {"cat.png": pngImage(t)}})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("openai-model"); got != "dall-e-2" {
+		t.Errorf("variations should default to dall-e-2, got %q", got)
+	}
+	req := wallflowerRequest(t, fake)
+	if seed := req.Feature.ModelConfig.Seed; seed == nil || *seed != 7 || req.Style != "Anime" {
+		t.Errorf("expected seed 7 and style Anime, got %v and %s", seed, req.Style)
+	}
+	if req.Feature.Type != "VARIATION" || req.Feature.ModelConfig.NumberOfImages != 3 || len(req.Attachments) != 1 {
+		t.Errorf("unexpected wallflower request %+v", req)
+	}
+}
+
+func TestImageEditInvalidParams(t *testing.T) {
+	image := map[string]map[string][]byte{"image": {"cat.png": pngImage(t)}}
+	tests := map[string]struct {
+		handler http.HandlerFunc
+		fields  map[string]string
+		files   map[string]map[string][]byte
+	}{
+		"missing prompt":   {api.HandleImageEdits, nil, image},
+		"missing image":    {api.HandleImageEdits, map[string]string{"prompt": "add a hat"}, nil},
+		"not an image":     {api.HandleImageEdits, map[string]string{"prompt": "add a hat"}, map[string]map[string][]byte{"image": {"cat.txt": []byte("hello")}}},
+		"bad n":            {api.HandleImageVariations, map[string]string{"n": "many"}, image},
+		"too many":         {api.HandleImageVariations, map[string]string{"n": "5"}, image},
+		"mask on variants": {api.HandleImageVariations, nil, map[string]map[string][]byte{"image": {"cat.png": pngImage(t)}, "mask": {"mask.png": pngImage(t)}}},
+		"response format":  {api.HandleImageVariations, map[string]string{"response_format": "svg"}, image},
+		"bad seed":         {api.HandleImageVariations, map[string]string{"seed": "random"}, image},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+
+			rec := postMultipart(t, tt.handler, "/v1/images/edits", tt.fields, tt.files)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if resp := decodeError(t, rec.Body.String()); resp.Error.Type != "invalid_request_error" {
+				t.Errorf("unexpected error %+v", resp.Error)
+			}
+			if n := len(fake.Requests()); n != 0 {
+				t.Errorf("invalid requests must not reach upstream, got %d requests", n)
+			}
+		})
+	}
+}
+
+func TestImageEditNotMultipart(t *testing.T) {
+	rec := httptest.NewRecorder()
+	api.HandleImageEdits(rec, httptest.NewRequest(http.MethodPost, "/v1/images/edits", strings.NewReader(`{"prompt":"a cat"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a JSON body, got %d", rec.Code)
+	}
+}
+
+func TestImageEditUploadFailure(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.Fail("/v1/wallflower/upload", http.StatusBadRequest, `{"status":"error","error":{"type":"INVALID_FILE","message":"unsupported image"}}`)
+
+	rec := postMultipart(t, api.HandleImageEdits, "/v1/images/edits",
+		map[string]string{"prompt": "add a hat"},
+		map[string]map[string][]byte{"image": {"cat.png": pngImage(t)}})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/wallflower/unified-generation" {
+			t.Errorf("generation must not start when the upload fails")
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+func decodeError(t *testing.T, body string) api.OpenAIErrorResponse {
+	t.Helper()
+	var resp api.OpenAIErrorResponse
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("Invalid error response %s: %v", body, err)
+	}
+	return resp
+}
+
+func TestUpstreamErrorMapping(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		wantStatus int
+		wantType   string
+		wantCode   string
+	}{
+		{"auth", http.StatusUnauthorized, `{"status":"error","error":{"type":"UNAUTHORIZED","message":"invalid access token"}}`, 401, "invalid_request_error", "invalid_api_key"},
+		{"quota", http.StatusForbidden, `{"status":"error","error":{"type":"USAGE_LIMIT_EXCEEDED","message":"daily quota used up"}}`, 429, "insufficient_quota", "insufficient_quota"},
+		{"rate limit", http.StatusTooManyRequests, `{"error":"slow down"}`, 429, "requests", "rate_limit_exceeded"},
+		{"content policy", http.StatusBadRequest, `{"status":"error","error":{"type":"CONTENT_POLICY_VIOLATION","message":"prompt rejected"}}`, 400, "invalid_request_error", "content_policy_violation"},
+		{"model unavailable", http.StatusBadRequest, `{"status":"error","error":{"type":"MODEL_NOT_AVAILABLE","message":"model is not available"}}`, 404, "invalid_request_error", "model_not_found"},
+		{"server error", http.StatusInternalServerError, `oops`, 502, "server_error", "upstream_error"},
+		{"keyword only in message", http.StatusInternalServerError, `{"status":"error","error":{"type":"INTERNAL","message":"quota service rate limit, model not found"}}`, 502, "server_error", "upstream_error"},
+		{"keyword only in message with status", http.StatusUnauthorized, `{"status":"error","error":{"type":"ERROR","message":"content policy check failed"}}`, 401, "invalid_request_error", "invalid_api_key"},
+	}
+
+	for _, tt := range tests {
+		for _, stream := range []bool{false, true} {
+			name := tt.name
+			if stream {
+				name += " stream"
+			}
+			t.Run(name, func(t *testing.T) {
+				fake := fakemerlin.New()
+				fake.Use(t)
+				t.Setenv("MERLIN_RETRY_MAX", "0")
+				fake.Fail("/v1/thread/unified", tt.status, tt.body)
+
+				rec := postChat(t, map[string]interface{}{
+					"messages": []map[string]string{{"role": "user", "content": "hi"}},
+					"stream":   stream,
+					"model":    "gpt-4o",
+				})
+
+				if rec.Code != tt.wantStatus {
+					t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+				}
+				resp := decodeError(t, rec.Body.String())
+				if resp.Error.Type != tt.wantType || resp.Error.Code != tt.wantCode {
+					t.Errorf("expected %s/%s, got %s/%s", tt.wantType, tt.wantCode, resp.Error.Type, resp.Error.Code)
+				}
+			})
+		}
+	}
+}
+
+func TestMidStreamErrorEvent(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("partial "), fakemerlin.Error("RATE_LIMIT", "too many requests"))
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 once the stream started, got %d", rec.Code)
+	}
+	data := streamData(rec.Body.String())
+	if len(data) == 0 {
+		t.Fatal("empty stream")
+	}
+	last := data[len(data)-1]
+	if last == "[DONE]" {
+		t.Fatalf("stream must end with the error event, got %v", data)
+	}
+	resp := decodeError(t, last)
+	if resp.Error.Code != "rate_limit_exceeded" || resp.Error.Message != "too many requests" {
+		t.Errorf("unexpected error event %s", last)
+	}
+	if !strings.Contains(rec.Body.String(), "partial ") {
+		t.Errorf("content before the error should be delivered")
+	}
+}
+
+func TestNonStreamErrorEvent(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Error("CONTENT_POLICY", "blocked"))
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"model":    "gpt-4o",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeError(t, rec.Body.String()); resp.Error.Code != "content_policy_violation" {
+		t.Errorf("unexpected error %+v", resp.Error)
+	}
+}
+
+func TestImageContentPolicyError(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.Fail("/v1/wallflower/unified-generation", http.StatusBadRequest, `{"status":"error","error":{"type":"NSFW_CONTENT","message":"prompt flagged"}}`)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(`{"prompt":"x","model":"flux-1.1-pro"}`))
+	api.HandleImageGenerations(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeError(t, rec.Body.String()); resp.Error.Code != "content_policy_violation" {
+		t.Errorf("unexpected error %+v", resp.Error)
+	}
+}
+
+func TestErrorEventKeywordOnlyInMessage(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("partial "), fakemerlin.Error("INTERNAL", "rate limit check on quota service failed"))
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	data := streamData(rec.Body.String())
+	if resp := decodeError(t, data[len(data)-1]); resp.Error.Code != "upstream_error" {
+		t.Errorf("keywords in the message must not decide the error code, got %+v", resp.Error)
+	}
+}
+
+// noFlushWriter 不支持 http.Flusher 的 ResponseWriter
+type noFlushWriter struct {
+	http.ResponseWriter
+}
+
+func TestHandlerErrorsAreOpenAIJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		path    string
+		body    string
+		flush   bool
+		status  int
+	}{
+		{"chat without flusher", api.HandleChat, "/v1/chat/completions", `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`, false, http.StatusInternalServerError},
+		{"legacy image method", api.HandleImageGeneration, "/web/v2/image-generation", "", true, http.StatusMethodNotAllowed},
+		{"legacy image body", api.HandleImageGeneration, "/web/v2/image-generation", `{`, true, http.StatusBadRequest},
+		{"legacy image without flusher", api.HandleImageGeneration, "/web/v2/image-generation", `{}`, false, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method := http.MethodPost
+			if tt.body == "" {
+				method = http.MethodGet
+			}
+			rec := httptest.NewRecorder()
+			var w http.ResponseWriter = rec
+			if !tt.flush {
+				w = noFlushWriter{rec}
+			}
+			tt.handler(w, httptest.NewRequest(method, tt.path, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.status {
+				t.Fatalf("expected %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected a JSON error, got Content-Type %q", ct)
+			}
+			if resp := decodeError(t, rec.Body.String()); resp.Error.Message == "" || resp.Error.Type == "" {
+				t.Errorf("incomplete error %+v", resp.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,384 @@
+// Package fakemerlin 提供一个进程内的假 Merlin 上游，模拟 session、UAM、thread/unified 和
+// wallflower/unified-generation 接口，用于离线测试。SSE 响应按脚本逐条发送。
+package fakemerlin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/auth"
+)
+
+// Event 一条脚本化的 SSE 事件，Data 原样写在 "data: " 之后
+type Event struct {
+	Event string
+	Data  string
+	Delay time.Duration
+	abort bool
+}
+
+// Content 生成一条聊天内容事件
+func Content(text string) Event {
+	return jsonEvent(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"content": text, "eventType": "CHUNK"},
+	})
+}
+
+// Done 生成聊天结束事件
+func Done() Event {
+	return jsonEvent(map[string]interface{}{
+		"status": "system",
+		"data":   map[string]interface{}{"content": "", "eventType": "DONE"},
+	})
+}
+
+// Error 生成一条流中的错误事件
+func Error(kind, message string) Event {
+	return jsonEvent(map[string]interface{}{
+		"status": "error",
+		"error":  map[string]string{"type": kind, "message": message},
+	})
+}
+
+// Variations 生成一条包含图片的 wallflower 事件
+func Variations(urls ...string) Event {
+	variations := make([]map[string]interface{}, 0, len(urls))
+	for i, url := range urls {
+		variations = append(variations, map[string]interface{}{
+			"url":  url,
+			"iid":  fmt.Sprintf("iid-%d", i),
+			"seed": 1000 + i,
+		})
+	}
+	return jsonEvent(map[string]interface{}{
+		"status":  "success",
+		"payload": []map[string]interface{}{{"variations": variations}},
+	})
+}
+
+// Raw 原样发送 data
+func Raw(data string) Event {
+	return Event{Data: data}
+}
+
+// Abort 在这一位置中断连接，模拟流在回答中途断开
+func Abort() Event {
+	return Event{abort: true}
+}
+
+func jsonEvent(v interface{}) Event {
+	data, _ := json.Marshal(v)
+	return Event{Data: string(data)}
+}
+
+// Request 假上游收到的请求
+type Request struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+type failure struct {
+	status int
+	body   string
+}
+
+type file struct {
+	contentType string
+	data        []byte
+}
+
+// Server 假 Merlin 上游，所有接口共用一个监听地址
+type Server struct {
+	*httptest.Server
+
+	SessionToken string
+	AccessToken  string
+	RefreshToken string
+
+	mu       sync.Mutex
+	backups  map[string]string
+	chat     [][]Event
+	image    [][]Event
+	failures map[string][]failure
+	files    map[string]file
+	requests []Request
+}
+
+// New 启动一个假上游
+func New() *Server {
+	s := &Server{
+		SessionToken: "fake-session-token",
+		AccessToken:  "fake-access-token",
+		RefreshToken: "fake-refresh-token",
+		backups:      make(map[string]string),
+		failures:     make(map[string][]failure),
+		files:        make(map[string]file),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleSession)
+	mux.HandleFunc("/session/get", s.handleRefresh)
+	mux.HandleFunc("/v1/thread/unified", s.handleChat)
+	mux.HandleFunc("/v1/wallflower/unified-generation", s.handleImage)
+	mux.HandleFunc("/v1/wallflower/upload", s.handleUpload)
+	mux.HandleFunc("/files/", s.handleFile)
+	s.Server = httptest.NewServer(s.record(mux))
+	return s
+}
+
+// Use 让被测代码在测试期间访问这个假上游，测试结束后自动关闭
+func (s *Server) Use(t testing.TB) {
+	t.Setenv("MERLIN_SESSION_URL", s.URL)
+	t.Setenv("MERLIN_UAM_URL", s.URL)
+	t.Setenv("MERLIN_ARCANE_URL", s.URL)
+	t.Setenv("MERLIN_SESSION_TOKEN", s.SessionToken)
+	t.Setenv("MERLIN_REFRESH_TOKEN", s.RefreshToken)
+	t.Setenv("MERLIN_TOKEN", "")
+	t.Setenv("MERLIN_BACKUP_SESSION_TOKENS", "")
+	auth.ClearTokenCache()
+	t.Cleanup(func() {
+		s.Close()
+		auth.ClearTokenCache()
+	})
+}
+
+// AddAccount 添加一个备用账号，返回它的 session token 和 access token
+func (s *Server) AddAccount(name string) (sessionToken, accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessionToken, accessToken = "fake-session-token-"+name, "fake-access-token-"+name
+	s.backups[sessionToken] = accessToken
+	return sessionToken, accessToken
+}
+
+// ScriptChat 追加一次 thread/unified 响应的事件序列，未设置脚本时返回默认回复
+func (s *Server) ScriptChat(events ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.chat = append(s.chat, events)
+}
+
+// ScriptImage 追加一次 wallflower 响应的事件序列，未设置脚本时返回两张图片
+func (s *Server) ScriptImage(events ...Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.image = append(s.image, events)
+}
+
+// ServeFile 在 /files/name 上返回指定内容，模拟存放生成图片的 CDN，返回文件的完整 URL
+func (s *Server) ServeFile(name, contentType string, data []byte) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files["/files/"+name] = file{contentType: contentType, data: data}
+	return s.URL + "/files/" + name
+}
+
+// Fail 让下一次访问 path 的请求返回指定状态码和响应体
+func (s *Server) Fail(path string, status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], failure{status: status, body: body})
+}
+
+// Requests 返回目前收到的全部请求
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) record(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(body)))
+
+		s.mu.Lock()
+		s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: body})
+		queued := s.failures[r.URL.Path]
+		var fail *failure
+		if len(queued) > 0 {
+			fail = &queued[0]
+			s.failures[r.URL.Path] = queued[1:]
+		}
+		s.mu.Unlock()
+
+		if fail != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(fail.status)
+			io.WriteString(w, fail.body)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodHead {
+		return
+	}
+	if r.URL.Path != "/" || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie("__Secure-authjs.session-token")
+	var accessToken string
+	if err == nil {
+		accessToken = s.accessTokenFor(cookie.Value)
+	}
+	if accessToken == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{}`)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user": map[string]string{
+			"accessToken": accessToken,
+			"email":       "fake@example.com",
+			"name":        "Fake User",
+		},
+		"expires": time.Now().Add(time.Hour).UTC().Format(time.RFC3339),
+	})
+}
+
+func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var body struct {
+		Token string `json:"token"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	if body.Token != s.RefreshToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"status":"error","error":{"type":"UNAUTHORIZED","message":"invalid refresh token"}}`)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data": map[string]string{
+			"accessToken":  "Bearer " + s.AccessToken,
+			"refreshToken": s.RefreshToken,
+		},
+	})
+}
+
+func (s *Server) accessTokenFor(sessionToken string) string {
+	if sessionToken == s.SessionToken {
+		return s.AccessToken
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backups[sessionToken]
+}
+
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	known := token == s.AccessToken
+	for _, accessToken := range s.backups {
+		known = known || token == accessToken
+	}
+	s.mu.Unlock()
+	if !known {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"status":"error","error":{"type":"UNAUTHORIZED","message":"invalid access token"}}`)
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	s.mu.Lock()
+	events := []Event{Content("Hello from fake Merlin"), Done()}
+	if len(s.chat) > 0 {
+		events, s.chat = s.chat[0], s.chat[1:]
+	}
+	s.mu.Unlock()
+	writeEvents(w, r, events)
+}
+
+func (s *Server) handleImage(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	s.mu.Lock()
+	events := []Event{
+		Variations("https://cdn.example.com/image-0.png", "https://cdn.example.com/image-1.png"),
+		Raw("[DONE]"),
+	}
+	if len(s.image) > 0 {
+		events, s.image = s.image[0], s.image[1:]
+	}
+	s.mu.Unlock()
+	writeEvents(w, r, events)
+}
+
+// handleUpload 保存上传的图片，在 /files/uploads/{filename} 上返回
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(w, r) {
+		return
+	}
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	url := s.ServeFile("uploads/"+header.Filename, header.Header.Get("Content-Type"), data)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]string{"url": url},
+	})
+}
+
+func (s *Server) handleFile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	f, ok := s.files[r.URL.Path]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write(f.data)
+}
+
+func writeEvents(w http.ResponseWriter, r *http.Request, events []Event) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher := w.(http.Flusher)
+
+	for _, event := range events {
+		if event.Delay > 0 {
+			select {
+			case <-time.After(event.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if event.abort {
+			panic(http.ErrAbortHandler)
+		}
+		if event.Event != "" {
+			fmt.Fprintf(w, "event: %s\n", event.Event)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", event.Data)
+		flusher.Flush()
+	}
+}
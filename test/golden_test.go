@@ -0,0 +1,83 @@
+package test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite golden stream files")
+
+var (
+	chunkIDPattern = regexp.MustCompile(`"id":"(chatcmpl-[^"]+)"`)
+	createdPattern = regexp.MustCompile(`"created":(\d+)`)
+)
+
+// normalizeStream 检查同一个流的所有块共用 id 和 created，然后把它们替换成固定值以便和参考流比较
+func normalizeStream(t *testing.T, body string) string {
+	t.Helper()
+	for _, pattern := range []*regexp.Regexp{chunkIDPattern, createdPattern} {
+		values := map[string]bool{}
+		for _, m := range pattern.FindAllStringSubmatch(body, -1) {
+			values[m[1]] = true
+		}
+		if len(values) > 1 {
+			t.Errorf("chunks of one stream must share %s, got %v", pattern, values)
+		}
+	}
+	body = chunkIDPattern.ReplaceAllString(body, `"id":"chatcmpl-test"`)
+	return createdPattern.ReplaceAllString(body, `"created":1700000000`)
+}
+
+func TestStreamGolden(t *testing.T) {
+	tests := []struct {
+		name         string
+		events       []fakemerlin.Event
+		includeUsage bool
+	}{
+		{"chat_stream", []fakemerlin.Event{fakemerlin.Content("Hello"), fakemerlin.Content(", world"), fakemerlin.Done()}, false},
+		{"chat_stream_error", []fakemerlin.Event{fakemerlin.Content("partial"), fakemerlin.Error("RATE_LIMIT", "too many requests")}, false},
+		{"chat_stream_empty", []fakemerlin.Event{fakemerlin.Done()}, false},
+		{"chat_stream_usage", []fakemerlin.Event{fakemerlin.Content("Hello"), fakemerlin.Content(", world"), fakemerlin.Done()}, true},
+		{"chat_stream_truncated", []fakemerlin.Event{fakemerlin.Content("partial")}, false},
+		{"chat_stream_abort", []fakemerlin.Event{fakemerlin.Content("partial"), fakemerlin.Abort()}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+			t.Setenv("STREAM_HEARTBEAT_INTERVAL", "0")
+			fake.ScriptChat(tt.events...)
+
+			request := map[string]interface{}{
+				"messages": []map[string]string{{"role": "user", "content": "hi"}},
+				"stream":   true,
+				"model":    "gpt-4o",
+			}
+			if tt.includeUsage {
+				request["stream_options"] = map[string]bool{"include_usage": true}
+			}
+			rec := postChat(t, request)
+			got := normalizeStream(t, rec.Body.String())
+
+			path := filepath.Join("testdata", "golden", tt.name+".txt")
+			if *updateGolden {
+				if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read golden file: %v", err)
+			}
+			if got != string(want) {
+				t.Errorf("stream does not match %s\ngot:\n%s\nwant:\n%s", path, got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+func TestHealthz(t *testing.T) {
+	rec := httptest.NewRecorder()
+	api.HandleHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestRootIsLiveness(t *testing.T) {
+	rec := httptest.NewRecorder()
+	api.HandleChat(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "Service Running") {
+		t.Errorf("expected / to answer like /healthz, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestUnknownPath(t *testing.T) {
+	rec := httptest.NewRecorder()
+	api.HandleChat(rec, httptest.NewRequest(http.MethodPost, "/v1/unknown", nil))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d: %s", rec.Code, rec.Body.String())
+	}
+	resp := decodeError(t, rec.Body.String())
+	if resp.Error.Type != "invalid_request_error" || resp.Error.Code != "unknown_url" || !strings.Contains(resp.Error.Message, "POST /v1/unknown") {
+		t.Errorf("unexpected error %+v", resp.Error)
+	}
+}
+
+func TestReadyzWithoutCredentials(t *testing.T) {
+	t.Setenv("MERLIN_SESSION_TOKEN", "")
+	t.Setenv("MERLIN_REFRESH_TOKEN", "")
+	t.Setenv("MERLIN_TOKEN", "")
+	auth.ResetStatus()
+	t.Cleanup(auth.ResetStatus)
+
+	rec := httptest.NewRecorder()
+	api.HandleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without credentials, got %d", rec.Code)
+	}
+}
+
+// tokenRequests 返回假上游收到的获取 token 请求数
+func tokenRequests(fake *fakemerlin.Server) int {
+	count := 0
+	for _, r := range fake.Requests() {
+		if r.Path == "/" || r.Path == "/session/get" {
+			count++
+		}
+	}
+	return count
+}
+
+func probeReadyz() int {
+	rec := httptest.NewRecorder()
+	api.HandleReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	return rec.Code
+}
+
+func TestReadyzRefreshesInBackground(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	auth.ResetStatus()
+	t.Cleanup(auth.ResetStatus)
+
+	for i := 0; i < 5; i++ {
+		if code := probeReadyz(); code != http.StatusServiceUnavailable && code != http.StatusOK {
+			t.Fatalf("unexpected status %d", code)
+		}
+	}
+	if n := tokenRequests(fake); n > 1 {
+		t.Errorf("probes must share a single background refresh, got %d token requests", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for probeReadyz() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatal("readyz did not become ready after the background refresh")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReadyzBacksOffAfterFailedRefresh(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.Fail("/", http.StatusInternalServerError, "down")
+	fake.Fail("/session/get", http.StatusInternalServerError, "down")
+	auth.ResetStatus()
+	t.Cleanup(auth.ResetStatus)
+
+	if code := probeReadyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 before any token was fetched, got %d", code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for tokenRequests(fake) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh did not run")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	attempts := tokenRequests(fake)
+
+	for i := 0; i < 5; i++ {
+		if code := probeReadyz(); code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503 while the refresh is failing, got %d", code)
+		}
+	}
+	if n := tokenRequests(fake); n != attempts {
+		t.Errorf("probes during the backoff must not fetch tokens, got %d token requests after %d", n, attempts)
+	}
+}
+
+func TestDebugStatusRequiresAdminKey(t *testing.T) {
+	t.Setenv("ADMIN_KEY", "")
+	rec := httptest.NewRecorder()
+	api.HandleDebugStatus(rec, httptest.NewRequest(http.MethodGet, "/debug/status", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 when ADMIN_KEY is unset, got %d", rec.Code)
+	}
+
+	t.Setenv("ADMIN_KEY", "secret")
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/debug/status", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	api.HandleDebugStatus(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 with a wrong key, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/debug/status", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	api.HandleDebugStatus(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the admin key, got %d", rec.Code)
+	}
+
+	var status struct {
+		Accounts []struct {
+			ID       string `json:"id"`
+			InFlight int64  `json:"in_flight"`
+		} `json:"accounts"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatalf("decode status failed: %v", err)
+	}
+	if status.Accounts == nil {
+		t.Error("status should list accounts")
+	}
+}
@@ -0,0 +1,158 @@
+package test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+func delayed(event fakemerlin.Event, delay time.Duration) fakemerlin.Event {
+	event.Delay = delay
+	return event
+}
+
+func TestStreamHeartbeat(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("STREAM_HEARTBEAT_INTERVAL", "20ms")
+	fake.ScriptChat(delayed(fakemerlin.Content("thought "), 150*time.Millisecond), delayed(fakemerlin.Content("hard"), 150*time.Millisecond), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "o1",
+	})
+
+	body := rec.Body.String()
+	if strings.Count(body, ": ping\n\n") < 2 {
+		t.Errorf("expected heartbeats while upstream is silent, got %q", body)
+	}
+	if got := streamedContent(t, body); got != "thought hard" {
+		t.Errorf("heartbeats must not change content, got %q", got)
+	}
+	if data := streamData(body); data[len(data)-1] != "[DONE]" {
+		t.Errorf("stream should end with [DONE], got %v", data)
+	}
+}
+
+func TestStreamHeartbeatDisabled(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("STREAM_HEARTBEAT_INTERVAL", "0")
+	fake.ScriptChat(delayed(fakemerlin.Content("slow"), 50*time.Millisecond), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "o1",
+	})
+
+	if strings.Contains(rec.Body.String(), ": ping") {
+		t.Errorf("heartbeats should be disabled, got %q", rec.Body.String())
+	}
+}
+
+func TestStreamUpstreamIdleTimeout(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("STREAM_HEARTBEAT_INTERVAL", "20ms")
+	fake.ScriptChat(fakemerlin.Content("partial"), delayed(fakemerlin.Content("never"), time.Second), fakemerlin.Done())
+
+	cfg := upstream.ConfigFromEnv()
+	cfg.StreamIdleTimeout = 100 * time.Millisecond
+	restore := upstream.SetClient(newUpstreamClient(t, cfg))
+	defer restore()
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "o1",
+	})
+
+	data := streamData(rec.Body.String())
+	resp := decodeError(t, data[len(data)-1])
+	if resp.Error.Type != "server_error" || resp.Error.Code != "timeout" {
+		t.Errorf("idle upstream should end the stream with a timeout error, got %s", data[len(data)-1])
+	}
+	if strings.Contains(rec.Body.String(), "never") {
+		t.Errorf("content after the timeout must not be sent")
+	}
+}
+
+func TestHeartbeatBeforeUpstreamResponds(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("STREAM_HEARTBEAT_INTERVAL", "20ms")
+	t.Setenv("MERLIN_RETRY_MAX", "0")
+	fake.ScriptChat(delayed(fakemerlin.Content("late"), time.Second), fakemerlin.Done())
+
+	cfg := upstream.ConfigFromEnv()
+	cfg.FirstByteTimeout = 100 * time.Millisecond
+	restore := upstream.SetClient(newUpstreamClient(t, cfg))
+	defer restore()
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "o1",
+	})
+
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, ": ping\n\n") {
+		t.Fatalf("expected heartbeats while waiting for upstream headers, got %q", body)
+	}
+	data := streamData(body)
+	if len(data) != 1 {
+		t.Fatalf("expected a single error event, got %v", data)
+	}
+	if resp := decodeError(t, data[0]); resp.Error.Code != "timeout" {
+		t.Errorf("expected a timeout error event, got %s", data[0])
+	}
+}
+
+// assertWellFormedError 响应要么是不含心跳的 JSON 错误，要么是只有注释和 data 行、以错误事件结束的流
+func assertWellFormedError(t *testing.T, status int, body string) {
+	t.Helper()
+	if status != http.StatusOK {
+		decodeError(t, body)
+		return
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if line != "" && !strings.HasPrefix(line, ":") && !strings.HasPrefix(line, "data: ") {
+			t.Fatalf("non-SSE line %q in stream %q", line, body)
+		}
+	}
+	data := streamData(body)
+	if len(data) == 0 {
+		t.Fatalf("expected an error event, got %q", body)
+	}
+	decodeError(t, data[len(data)-1])
+}
+
+func TestHeartbeatStopsBeforeUpstreamError(t *testing.T) {
+	t.Setenv("MERLIN_RETRY_MAX", "0")
+	for _, model := range []string{"o1", "flux-1.1-pro"} {
+		path := "/v1/thread/unified"
+		if model == "flux-1.1-pro" {
+			path = "/v1/wallflower/unified-generation"
+		}
+		fake := fakemerlin.New()
+		fake.Use(t)
+		// 心跳间隔从小到大扫过上游返回错误所需的时间，让第一个心跳和错误几乎同时发生
+		for interval := 50 * time.Microsecond; interval <= 3*time.Millisecond; interval += 25 * time.Microsecond {
+			t.Setenv("STREAM_HEARTBEAT_INTERVAL", interval.String())
+			fake.Fail(path, http.StatusInternalServerError, `{"status":"error","error":{"type":"INTERNAL","message":"boom"}}`)
+
+			rec := postChat(t, map[string]interface{}{
+				"messages": []map[string]string{{"role": "user", "content": "hi"}},
+				"stream":   true,
+				"model":    model,
+			})
+			assertWellFormedError(t, rec.Code, rec.Body.String())
+		}
+	}
+}
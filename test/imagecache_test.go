@@ -0,0 +1,178 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// useImageCache 在测试期间启用图片结果缓存
+func useImageCache(t *testing.T, ttl time.Duration, size int) {
+	t.Helper()
+	t.Cleanup(api.SetImageCache(ttl, size))
+}
+
+// postCachedImages 发送带 Cache-Control 头的图片生成请求
+func postCachedImages(t *testing.T, body map[string]interface{}, cacheControl string) *httptest.ResponseRecorder {
+	t.Helper()
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(string(jsonData)))
+	if cacheControl != "" {
+		req.Header.Set("Cache-Control", cacheControl)
+	}
+	api.HandleImageGenerations(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return rec
+}
+
+// generationRequests 返回假上游收到的图片生成请求数
+func generationRequests(fake *fakemerlin.Server) int {
+	count := 0
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/wallflower/unified-generation" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestImageCacheHit(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, time.Minute, 10)
+	body := map[string]interface{}{"prompt": "a cat", "n": 2, "seed": 7}
+
+	first := decodeImages(t, postCachedImages(t, body, ""))
+	second := decodeImages(t, postCachedImages(t, body, ""))
+
+	if n := generationRequests(fake); n != 1 {
+		t.Errorf("expected the second request to be served from the cache, got %d upstream requests", n)
+	}
+	if len(second) != 2 || second[0].URL != first[0].URL || second[1].URL != first[1].URL {
+		t.Errorf("cached images differ: %+v vs %+v", second, first)
+	}
+}
+
+func TestImageCacheKey(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, time.Minute, 10)
+
+	for _, body := range []map[string]interface{}{
+		{"prompt": "a cat"},
+		{"prompt": "a dog"},
+		{"prompt": "a cat", "model": "recraft-v3"},
+		{"prompt": "a cat", "size": "1792x1024"},
+		{"prompt": "a cat", "n": 2},
+		{"prompt": "a cat", "seed": 1},
+	} {
+		postCachedImages(t, body, "")
+	}
+
+	if n := generationRequests(fake); n != 6 {
+		t.Errorf("requests with different parameters must not share results, got %d upstream requests", n)
+	}
+}
+
+func TestImageCacheDisabledByDefault(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+
+	if n := generationRequests(fake); n != 2 {
+		t.Errorf("expected no caching without IMAGE_CACHE_TTL, got %d upstream requests", n)
+	}
+}
+
+func TestImageCacheExpires(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, 50*time.Millisecond, 10)
+
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+	time.Sleep(100 * time.Millisecond)
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+
+	if n := generationRequests(fake); n != 2 {
+		t.Errorf("expected the expired result to be generated again, got %d upstream requests", n)
+	}
+}
+
+func TestImageCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, time.Minute, 2)
+
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+	postCachedImages(t, map[string]interface{}{"prompt": "a dog"}, "")
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+	postCachedImages(t, map[string]interface{}{"prompt": "a bird"}, "")
+	if n := generationRequests(fake); n != 3 {
+		t.Fatalf("expected 3 upstream requests, got %d", n)
+	}
+
+	// a dog 最久未使用，已被淘汰
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+	postCachedImages(t, map[string]interface{}{"prompt": "a dog"}, "")
+	if n := generationRequests(fake); n != 4 {
+		t.Errorf("expected only the least recently used result to be evicted, got %d upstream requests", n)
+	}
+}
+
+func TestImageCacheBypass(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, time.Minute, 10)
+	fake.ScriptImage(fakemerlin.Variations("https://cdn.example.com/old.png"), fakemerlin.Raw("[DONE]"))
+	fake.ScriptImage(fakemerlin.Variations("https://cdn.example.com/new.png"), fakemerlin.Raw("[DONE]"))
+	body := map[string]interface{}{"prompt": "a cat", "n": 1}
+
+	postCachedImages(t, body, "")
+	bypassed := decodeImages(t, postCachedImages(t, body, "no-cache"))
+	cached := decodeImages(t, postCachedImages(t, body, ""))
+
+	if n := generationRequests(fake); n != 2 {
+		t.Errorf("expected no-cache to skip the cache, got %d upstream requests", n)
+	}
+	if bypassed[0].URL != "https://cdn.example.com/new.png" || cached[0].URL != "https://cdn.example.com/new.png" {
+		t.Errorf("expected the bypassed result to refresh the cache, got %q and %q", bypassed[0].URL, cached[0].URL)
+	}
+}
+
+func TestImageCacheNoStore(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	useImageCache(t, time.Minute, 10)
+
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "no-store")
+	postCachedImages(t, map[string]interface{}{"prompt": "a cat"}, "")
+
+	if n := generationRequests(fake); n != 2 {
+		t.Errorf("expected no-store results not to be cached, got %d upstream requests", n)
+	}
+}
+
+func TestImageCacheSwapDoesNotLeakGoroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		api.SetImageCache(time.Minute, 10)()
+	}
+	if after := runtime.NumGoroutine(); after > before+10 {
+		t.Errorf("replacing the cache leaked goroutines: %d before, %d after", before, after)
+	}
+}
@@ -0,0 +1,339 @@
+package test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// postImages 直接调用图片生成 handler
+func postImages(t *testing.T, body map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(string(jsonData)))
+	api.HandleImageGenerations(rec, req)
+	return rec
+}
+
+// wallflowerRequest 返回假上游收到的最后一个图片生成请求
+func wallflowerRequest(t *testing.T, fake *fakemerlin.Server) api.WallflowerRequest {
+	t.Helper()
+	var req api.WallflowerRequest
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/wallflower/unified-generation" {
+			if err := json.Unmarshal(r.Body, &req); err != nil {
+				t.Fatalf("Invalid wallflower request %s: %v", r.Body, err)
+			}
+		}
+	}
+	return req
+}
+
+func TestImageSizeMapping(t *testing.T) {
+	tests := map[string]string{
+		"1024x1024": "1:1",
+		"512x512":   "1:1",
+		"1792x1024": "16:9",
+		"1024x1792": "9:16",
+		"1536x1024": "3:2",
+		"1024x1536": "2:3",
+		"1024x768":  "4:3",
+		"auto":      "1:1",
+	}
+	for size, want := range tests {
+		t.Run(size, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+
+			rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "size": size})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if got := wallflowerRequest(t, fake).Feature.ModelConfig.AspectRatio; got != want {
+				t.Errorf("size %s: expected aspect ratio %s, got %s", size, want, got)
+			}
+		})
+	}
+}
+
+func TestImageCount(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	urls := []string{"https://cdn.example.com/a.png", "https://cdn.example.com/b.png", "https://cdn.example.com/c.png"}
+	fake.ScriptImage(fakemerlin.Variations(urls...), fakemerlin.Raw("[DONE]"))
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "recraft-v3", "n": 3})
+
+	config := wallflowerRequest(t, fake).Feature.ModelConfig
+	if config.NumberOfImages != 3 || config.ModelId != "fal-ai/recraft-v3" {
+		t.Errorf("unexpected model config %+v", config)
+	}
+	for _, url := range urls {
+		if !strings.Contains(rec.Body.String(), url) {
+			t.Errorf("expected %s in response: %s", url, rec.Body.String())
+		}
+	}
+}
+
+func TestImageFewerThanRequested(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptImage(fakemerlin.Variations("https://cdn.example.com/only.png"), fakemerlin.Raw("[DONE]"))
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "n": 2})
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "https://cdn.example.com/only.png") {
+		t.Fatalf("expected the single image to be returned, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestImageOpenAIModel(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "dall-e-3"})
+
+	if got := wallflowerRequest(t, fake).Feature.ModelConfig.ModelId; got != "black-forest-labs/flux-1.1-pro" {
+		t.Errorf("dall-e-3 should map to the default Merlin model, got %s", got)
+	}
+	if got := rec.Header().Get("openai-model"); got != "dall-e-3" {
+		t.Errorf("response should report the requested model, got %q", got)
+	}
+}
+
+func TestImageGenerationsJSON(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "n": 2})
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("expected a JSON response, got %s: %s", ct, rec.Body.String())
+	}
+	var response api.OpenAIImageGenerationResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	if response.Created == 0 || len(response.Data) != 2 {
+		t.Fatalf("unexpected response %s", rec.Body.String())
+	}
+	for i, image := range response.Data {
+		if image.URL != fmt.Sprintf("https://cdn.example.com/image-%d.png", i) || image.RevisedPrompt != "a cat" {
+			t.Errorf("unexpected image %+v", image)
+		}
+	}
+	if strings.Contains(rec.Body.String(), "b64_json") {
+		t.Errorf("url responses must not contain b64_json: %s", rec.Body.String())
+	}
+}
+
+func TestImageInvalidParams(t *testing.T) {
+	for name, body := range map[string]map[string]interface{}{
+		"too many":    {"prompt": "a cat", "n": 5},
+		"negative":    {"prompt": "a cat", "n": -1},
+		"bad size":    {"prompt": "a cat", "size": "huge"},
+		"bad quality": {"prompt": "a cat", "quality": "ultra"},
+		"bad seed":    {"prompt": "a cat", "seed": -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+
+			rec := postImages(t, body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if resp := decodeError(t, rec.Body.String()); resp.Error.Type != "invalid_request_error" {
+				t.Errorf("unexpected error %+v", resp.Error)
+			}
+			if n := len(fake.Requests()); n != 0 {
+				t.Errorf("invalid requests must not reach upstream, got %d requests", n)
+			}
+		})
+	}
+}
+
+func TestImageGenerationParams(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postImages(t, map[string]interface{}{
+		"prompt":          "a cat",
+		"model":           "flux-1.1-pro",
+		"style":           "Anime",
+		"quality":         "hd",
+		"negative_prompt": "blurry",
+		"seed":            42,
+		"prompt_magic":    true,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	req := wallflowerRequest(t, fake)
+	if req.Style != "Anime" || req.NegativePrompt != "blurry" || !req.MerlinPromptMagic {
+		t.Errorf("unexpected wallflower request %+v", req)
+	}
+	if seed := req.Feature.ModelConfig.Seed; seed == nil || *seed != 42 {
+		t.Errorf("expected seed 42, got %v", seed)
+	}
+}
+
+func TestImageGenerationDefaultParams(t *testing.T) {
+	for _, style := range []string{"", "vivid", "natural"} {
+		t.Run(style, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+
+			postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "style": style})
+
+			req := wallflowerRequest(t, fake)
+			if req.Style != "Auto" || req.MerlinPromptMagic || req.Feature.ModelConfig.Seed != nil {
+				t.Errorf("unexpected wallflower request %+v", req)
+			}
+		})
+	}
+}
+
+func TestImageReturnsSeeds(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	images := decodeImages(t, postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "n": 2}))
+
+	for i, image := range images {
+		if image.Seed == nil || *image.Seed != 1000+i || image.IID != fmt.Sprintf("iid-%d", i) {
+			t.Errorf("image %d should report its seed and iid, got %+v", i, image)
+		}
+	}
+}
+
+// losslessWebP 1x1 的无损 webp 图片
+const losslessWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func pngImage(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{R: 255, A: 255})
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeImages(t *testing.T, rec *httptest.ResponseRecorder) []api.ImageData {
+	t.Helper()
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var response api.OpenAIImageGenerationResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	return response.Data
+}
+
+func TestImageB64JSON(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	data := pngImage(t)
+	fake.ScriptImage(fakemerlin.Variations(fake.ServeFile("a.png", "image/png", data), fake.ServeFile("b.png", "image/png", data)), fakemerlin.Raw("[DONE]"))
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "n": 2, "response_format": "b64_json"})
+
+	images := decodeImages(t, rec)
+	if len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d", len(images))
+	}
+	for _, image := range images {
+		if image.URL != "" {
+			t.Errorf("b64_json responses must not contain url: %s", image.URL)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(image.B64JSON)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("b64_json does not match the generated image: %v", err)
+		}
+	}
+}
+
+func TestImageWebPToPNG(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	webp, _ := base64.StdEncoding.DecodeString(losslessWebP)
+	fake.ScriptImage(fakemerlin.Variations(fake.ServeFile("a.webp", "image/webp", webp)), fakemerlin.Raw("[DONE]"))
+	fake.ScriptImage(fakemerlin.Variations(fake.ServeFile("a.webp", "image/webp", webp)), fakemerlin.Raw("[DONE]"))
+	request := map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "response_format": "b64_json"}
+
+	// 默认保持原格式
+	decoded, _ := base64.StdEncoding.DecodeString(decodeImages(t, postImages(t, request))[0].B64JSON)
+	if !bytes.Equal(decoded, webp) {
+		t.Errorf("webp should be returned unchanged by default")
+	}
+
+	t.Setenv("IMAGE_WEBP_TO_PNG", "true")
+	decoded, _ = base64.StdEncoding.DecodeString(decodeImages(t, postImages(t, request))[0].B64JSON)
+	img, err := png.Decode(bytes.NewReader(decoded))
+	if err != nil {
+		t.Fatalf("expected a png image: %v", err)
+	}
+	if img.Bounds().Dx() != 1 || img.Bounds().Dy() != 1 {
+		t.Errorf("unexpected image size %v", img.Bounds())
+	}
+}
+
+func TestImageB64JSONFetchErrors(t *testing.T) {
+	tests := map[string]func(fake *fakemerlin.Server) string{
+		"not an image": func(fake *fakemerlin.Server) string {
+			return fake.ServeFile("page.html", "text/html", []byte("<html></html>"))
+		},
+		"missing": func(fake *fakemerlin.Server) string {
+			return fake.URL + "/files/missing.png"
+		},
+		"too large": func(fake *fakemerlin.Server) string {
+			return fake.ServeFile("big.png", "image/png", make([]byte, 2048))
+		},
+	}
+	for name, serve := range tests {
+		t.Run(name, func(t *testing.T) {
+			fake := fakemerlin.New()
+			fake.Use(t)
+			t.Setenv("MERLIN_IMAGE_MAX_BYTES", "1024")
+			fake.ScriptImage(fakemerlin.Variations(serve(fake)), fakemerlin.Raw("[DONE]"))
+
+			rec := postImages(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "response_format": "b64_json"})
+
+			if rec.Code != http.StatusBadGateway {
+				t.Fatalf("expected 502, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if resp := decodeError(t, rec.Body.String()); resp.Error.Code != "upstream_error" {
+				t.Errorf("unexpected error %+v", resp.Error)
+			}
+		})
+	}
+}
+
+func TestImageInvalidResponseFormat(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	rec := postImages(t, map[string]interface{}{"prompt": "a cat", "response_format": "svg"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
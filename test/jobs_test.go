@@ -0,0 +1,306 @@
+package test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// startImageJobs 在测试期间启动图片任务的 worker
+func startImageJobs(t *testing.T) {
+	t.Helper()
+	stop := api.StartImageJobs()
+	t.Cleanup(func() { stop(context.Background()) })
+}
+
+func postJob(t *testing.T, body map[string]interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("Failed to marshal request body: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	api.HandleImageJobs(rec, httptest.NewRequest(http.MethodPost, "/v1/images/jobs", strings.NewReader(string(jsonData))))
+	return rec
+}
+
+func getJob(t *testing.T, id string) (int, api.ImageJob) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	api.HandleImageJobs(rec, httptest.NewRequest(http.MethodGet, "/v1/images/jobs/"+id, nil))
+	var job api.ImageJob
+	if rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+			t.Fatalf("Invalid job %s: %v", rec.Body.String(), err)
+		}
+	}
+	return rec.Code, job
+}
+
+func decodeJob(t *testing.T, rec *httptest.ResponseRecorder) api.ImageJob {
+	t.Helper()
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var job api.ImageJob
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil {
+		t.Fatalf("Invalid job %s: %v", rec.Body.String(), err)
+	}
+	return job
+}
+
+// waitJob 轮询任务直到状态为 status
+func waitJob(t *testing.T, id string, status string) api.ImageJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, job := getJob(t, id)
+		if code != http.StatusOK {
+			t.Fatalf("expected 200 for job %s, got %d", id, code)
+		}
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is still %s, expected %s", id, job.Status, status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImageJobLifecycle(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	startImageJobs(t)
+
+	rec := postJob(t, map[string]interface{}{"prompt": "a cat", "model": "flux-1.1-pro", "n": 2})
+
+	job := decodeJob(t, rec)
+	if !strings.HasPrefix(job.ID, "imgjob_") || job.Object != "image.job" || job.Status != "queued" || job.Model != "flux-1.1-pro" {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if got := rec.Header().Get("Location"); got != "/v1/images/jobs/"+job.ID {
+		t.Errorf("unexpected Location %q", got)
+	}
+
+	job = waitJob(t, job.ID, "succeeded")
+	if job.CompletedAt == 0 || job.Result == nil || len(job.Result.Data) != 2 || job.Result.Data[0].URL != "https://cdn.example.com/image-0.png" {
+		t.Errorf("unexpected result %+v", job)
+	}
+}
+
+func TestImageJobFailure(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	startImageJobs(t)
+	fake.ScriptImage(fakemerlin.Error("CONTENT_POLICY", "prompt was flagged"))
+
+	job := waitJob(t, decodeJob(t, postJob(t, map[string]interface{}{"prompt": "a cat"})).ID, "failed")
+
+	if job.Error == nil || job.Error.Code != "content_policy_violation" || job.Result != nil {
+		t.Errorf("unexpected failed job %+v", job)
+	}
+}
+
+// webhookReceiver 记录收到的回调，前 failures 次返回 500
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+	if len(wr.requests) <= wr.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	close(wr.received)
+}
+
+func TestImageJobWebhook(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("IMAGE_JOB_WEBHOOK_SECRET", "s3cret")
+	t.Setenv("IMAGE_JOB_WEBHOOK_RETRY_WAIT", "10ms")
+	t.Setenv("IMAGE_JOB_WEBHOOK_ALLOWED_HOSTS", "127.0.0.1")
+	startImageJobs(t)
+	receiver := &webhookReceiver{failures: 1, received: make(chan struct{})}
+	callback := httptest.NewServer(receiver)
+	defer callback.Close()
+
+	job := decodeJob(t, postJob(t, map[string]interface{}{"prompt": "a cat", "callback_url": callback.URL + "/hook"}))
+
+	select {
+	case <-receiver.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 2 {
+		t.Fatalf("expected one retry after the failed delivery, got %d requests", len(receiver.requests))
+	}
+
+	r, body := receiver.requests[1], receiver.bodies[1]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(r.Header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(body)
+	if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("invalid signature %q, expected %q", got, want)
+	}
+	if r.Header.Get("X-Webhook-Id") != job.ID {
+		t.Errorf("unexpected webhook id %q", r.Header.Get("X-Webhook-Id"))
+	}
+
+	var delivered api.ImageJob
+	if err := json.Unmarshal(body, &delivered); err != nil {
+		t.Fatalf("Invalid webhook body %s: %v", body, err)
+	}
+	if delivered.ID != job.ID || delivered.Status != "succeeded" || delivered.Result == nil {
+		t.Errorf("unexpected webhook body %s", body)
+	}
+}
+
+func TestImageJobWebhookRejectsInternalAddresses(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("IMAGE_JOB_WEBHOOK_SECRET", "s3cret")
+	startImageJobs(t)
+
+	for _, callback := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://10.0.0.5/hook",
+		"http://192.168.1.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://[fd00::1]/hook",
+		"http://100.64.0.1/hook",
+		"http://0.0.0.0/hook",
+	} {
+		if rec := postJob(t, map[string]interface{}{"prompt": "a cat", "callback_url": callback}); rec.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for %s, got %d: %s", callback, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestImageJobWebhookChecksResolvedAddress(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("IMAGE_JOB_WEBHOOK_SECRET", "s3cret")
+	t.Setenv("IMAGE_JOB_WEBHOOK_ATTEMPTS", "1")
+	startImageJobs(t)
+	receiver := &webhookReceiver{received: make(chan struct{})}
+	callback := httptest.NewServer(receiver)
+	defer callback.Close()
+	failed := testutil.ToFloat64(metrics.ImageJobWebhooksTotal.WithLabelValues("failed"))
+
+	// localhost 在提交时无法判断，连接时解析为回环地址后被拒绝
+	hook := strings.Replace(callback.URL, "127.0.0.1", "localhost", 1) + "/hook"
+	decodeJob(t, postJob(t, map[string]interface{}{"prompt": "a cat", "callback_url": hook}))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(metrics.ImageJobWebhooksTotal.WithLabelValues("failed")) == failed {
+		if time.Now().After(deadline) {
+			t.Fatal("webhook to a loopback address was not rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.requests) != 0 {
+		t.Errorf("webhook reached a loopback address: %d requests", len(receiver.requests))
+	}
+}
+
+func TestImageJobWebhookAllowedHosts(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("IMAGE_JOB_WEBHOOK_SECRET", "s3cret")
+	t.Setenv("IMAGE_JOB_WEBHOOK_ALLOWED_HOSTS", "hooks.internal, 10.0.0.5")
+	t.Setenv("IMAGE_JOB_WEBHOOK_ATTEMPTS", "1")
+	t.Setenv("IMAGE_JOB_WEBHOOK_TIMEOUT", "100ms")
+	startImageJobs(t)
+
+	for callback, want := range map[string]int{
+		"http://hooks.internal/hook":  http.StatusAccepted,
+		"http://10.0.0.5:9000/hook":   http.StatusAccepted,
+		"https://example.com/hook":    http.StatusBadRequest,
+		"http://169.254.169.254/hook": http.StatusBadRequest,
+	} {
+		if rec := postJob(t, map[string]interface{}{"prompt": "a cat", "callback_url": callback}); rec.Code != want {
+			t.Errorf("expected %d for %s, got %d: %s", want, callback, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestImageJobQueueFull(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("IMAGE_JOB_WORKERS", "1")
+	t.Setenv("IMAGE_JOB_QUEUE_SIZE", "1")
+	startImageJobs(t)
+	slow := []fakemerlin.Event{delayed(fakemerlin.Variations("https://cdn.example.com/slow.png"), 300*time.Millisecond), fakemerlin.Raw("[DONE]")}
+	fake.ScriptImage(slow...)
+	fake.ScriptImage(slow...)
+
+	first := decodeJob(t, postJob(t, map[string]interface{}{"prompt": "a cat"}))
+	waitJob(t, first.ID, "running")
+	second := decodeJob(t, postJob(t, map[string]interface{}{"prompt": "a dog"}))
+
+	rec := postJob(t, map[string]interface{}{"prompt": "a bird"})
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 when the queue is full, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	waitJob(t, first.ID, "succeeded")
+	waitJob(t, second.ID, "succeeded")
+}
+
+func TestImageJobInvalidRequests(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	startImageJobs(t)
+
+	for name, body := range map[string]map[string]interface{}{
+		"missing prompt":    {"model": "flux-1.1-pro"},
+		"bad size":          {"prompt": "a cat", "size": "huge"},
+		"bad callback":      {"prompt": "a cat", "callback_url": "ftp://example.com/hook"},
+		"callback no token": {"prompt": "a cat", "callback_url": "https://example.com/hook"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if rec := postJob(t, body); rec.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if code, _ := getJob(t, "imgjob_missing"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown job, got %d", code)
+	}
+}
+
+func TestImageJobsNotStarted(t *testing.T) {
+	if rec := postJob(t, map[string]interface{}{"prompt": "a cat"}); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 when image jobs are not running, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// startDrainServer 启动一个挂了排空控制器的聊天服务
+func startDrainServer(t *testing.T) (*api.Drain, http.Handler, *http.Server, string) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/chat/completions", api.HandleChat)
+	drain := api.NewDrain()
+	handler := api.WithDrain(drain, mux)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &http.Server{Handler: handler}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return drain, handler, server, "http://" + ln.Addr().String()
+}
+
+// openStream 发起一个流式聊天请求，读到第一条内容后返回
+func openStream(t *testing.T, baseURL string) (*http.Response, *bufio.Reader) {
+	t.Helper()
+	resp, err := http.Post(baseURL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before the first content: %v", err)
+		}
+		if strings.Contains(line, "partial") {
+			return resp, reader
+		}
+	}
+}
+
+// shutdownAsync 在后台关闭服务并等待进入排空状态
+func shutdownAsync(t *testing.T, drain *api.Drain, server *http.Server, timeout time.Duration) <-chan struct{} {
+	t.Helper()
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		drain.Shutdown(ctx, server)
+	}()
+	for !drain.Draining() {
+		time.Sleep(time.Millisecond)
+	}
+	return stopped
+}
+
+func TestShutdownCutsSlowStream(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("partial"), delayed(fakemerlin.Content("never sent"), 10*time.Second), fakemerlin.Done())
+
+	drain, handler, server, baseURL := startDrainServer(t)
+	_, reader := openStream(t, baseURL)
+	stopped := shutdownAsync(t, drain, server, 200*time.Millisecond)
+
+	// 排空期间的新请求直接返回 503
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"messages":[{"role":"user","content":"hi"}]}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 while draining, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	data := streamData(string(rest))
+	if len(data) < 2 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("expected the cut stream to end with [DONE], got %q", data)
+	}
+	if resp := decodeError(t, data[len(data)-2]); resp.Error.Code != "server_shutdown" {
+		t.Errorf("expected a server_shutdown error chunk before [DONE], got %+v", resp.Error)
+	}
+	if strings.Contains(string(rest), "never sent") {
+		t.Errorf("content after the cut reached the client: %s", rest)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return after cutting the stream")
+	}
+}
+
+func TestShutdownWaitsForStream(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("partial"), delayed(fakemerlin.Content(" answer"), 100*time.Millisecond), fakemerlin.Done())
+
+	drain, _, server, baseURL := startDrainServer(t)
+	_, reader := openStream(t, baseURL)
+	stopped := shutdownAsync(t, drain, server, 5*time.Second)
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	if !strings.Contains(string(rest), " answer") || strings.Contains(string(rest), "server_shutdown") {
+		t.Errorf("expected the stream to finish normally within the drain deadline, got %s", rest)
+	}
+	<-stopped
+}
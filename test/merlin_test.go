@@ -0,0 +1,144 @@
+package test
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/merlin"
+)
+
+func TestMerlinParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []merlin.Event
+	}{
+		{
+			name: "content chunk",
+			data: `{"status":"success","data":{"content":"Hi","eventType":"CHUNK"}}`,
+			want: []merlin.Event{merlin.ContentEvent{Text: "Hi"}},
+		},
+		{
+			name: "empty chunk",
+			data: `{"status":"success","data":{"content":"","eventType":"CHUNK"}}`,
+			want: nil,
+		},
+		{
+			name: "system done with message attachments",
+			data: `{"status":"system","data":{"content":"ignored","eventType":"DONE","message":{"attachments":[{"type":"IMAGE","url":"https://cdn.example.com/a.png"}]}}}`,
+			want: []merlin.Event{
+				merlin.AttachmentEvent{Attachments: []merlin.Attachment{{Type: "IMAGE", URL: "https://cdn.example.com/a.png"}}},
+				merlin.DoneEvent{},
+			},
+		},
+		{
+			name: "chunk with data attachments and citations",
+			data: `{"status":"success","data":{"content":"see","eventType":"CHUNK","attachments":[{"type":"IMAGE","url":"u"}],"citations":[{"title":"Go","url":"https://go.dev"}]}}`,
+			want: []merlin.Event{
+				merlin.ContentEvent{Text: "see"},
+				merlin.AttachmentEvent{Attachments: []merlin.Attachment{{Type: "IMAGE", URL: "u"}}},
+				merlin.CitationEvent{Citations: []merlin.Citation{{Title: "Go", URL: "https://go.dev"}}},
+			},
+		},
+		{
+			name: "usage",
+			data: `{"status":"system","data":{"eventType":"DONE","usage":{"promptTokens":3,"completionTokens":5,"totalTokens":8}}}`,
+			want: []merlin.Event{
+				merlin.UsageEvent{Usage: merlin.Usage{PromptTokens: 3, CompletionTokens: 5, TotalTokens: 8}},
+				merlin.DoneEvent{},
+			},
+		},
+		{
+			name: "error object",
+			data: `{"status":"error","error":{"type":"RATE_LIMIT","message":"slow down"}}`,
+			want: []merlin.Event{merlin.ErrorEvent{Type: "RATE_LIMIT", Message: "slow down"}},
+		},
+		{
+			name: "error string in data",
+			data: `{"status":"success","data":{"eventType":"CHUNK","error":"boom"}}`,
+			want: []merlin.Event{merlin.ErrorEvent{Message: "boom"}},
+		},
+		{
+			name: "wallflower progress",
+			data: `{"status":"processing","payload":[{"status":"generating","progress":40}]}`,
+			want: []merlin.Event{merlin.ProgressEvent{Status: "generating", Percent: 40}},
+		},
+		{
+			name: "wallflower status without progress",
+			data: `{"status":"queued"}`,
+			want: []merlin.Event{merlin.ProgressEvent{Status: "queued", Percent: -1}},
+		},
+		{
+			name: "wallflower payload status",
+			data: `{"status":"processing","payload":[{"status":"generating"}]}`,
+			want: []merlin.Event{merlin.ProgressEvent{Status: "generating", Percent: -1}},
+		},
+		{
+			name: "wallflower variations",
+			data: `{"status":"success","payload":[{"variations":[{"url":"a","iid":"i0","seed":1},{"url":""}]}]}`,
+			want: []merlin.Event{merlin.ImagesEvent{Variations: []merlin.Variation{{URL: "a", IID: "i0", Seed: 1}}}},
+		},
+		{
+			name: "raw done",
+			data: `[DONE]`,
+			want: []merlin.Event{merlin.DoneEvent{}},
+		},
+		{
+			name: "unknown event type",
+			data: `{"status":"success","data":{"eventType":"THINKING","content":"hmm"}}`,
+			want: []merlin.Event{
+				merlin.ContentEvent{Text: "hmm"},
+				merlin.UnknownEvent{Data: `{"status":"success","data":{"eventType":"THINKING","content":"hmm"}}`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := merlin.Parse("", tt.data)
+			if err != nil {
+				t.Fatalf("parse failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %#v, got %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMerlinDecoderLogsUnknownEvents(t *testing.T) {
+	var logs bytes.Buffer
+	output := log.Writer()
+	log.SetOutput(&logs)
+	defer log.SetOutput(output)
+
+	body := "event: mystery\ndata: {\"foo\":1}\n\n" +
+		"data: not json\n\n" +
+		"data: {\"status\":\"success\",\"data\":{\"content\":\"ok\",\"eventType\":\"CHUNK\"}}\n\n" +
+		"data: [DONE]\n\n"
+
+	decoder := merlin.NewDecoder(strings.NewReader(body))
+	var got []merlin.Event
+	for decoder.Next() {
+		got = append(got, decoder.Event())
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+
+	want := []merlin.Event{
+		merlin.UnknownEvent{Name: "mystery", Data: `{"foo":1}`},
+		merlin.UnknownEvent{Name: "message", Data: "not json"},
+		merlin.ContentEvent{Text: "ok"},
+		merlin.DoneEvent{},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %#v, got %#v", want, got)
+	}
+	if !strings.Contains(logs.String(), `unknown Merlin event "mystery"`) || !strings.Contains(logs.String(), "not json") {
+		t.Errorf("expected unknown events to be logged, got: %s", logs.String())
+	}
+}
@@ -0,0 +1,79 @@
+package test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+func TestInstrumentCountsSSE(t *testing.T) {
+	handler := metrics.Instrument("/test/sse", func(w http.ResponseWriter, r *http.Request) {
+		metrics.SetModel(r.Context(), "gpt-4o")
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("instrumented writer must support flushing")
+		}
+		for i := 0; i < 3; i++ {
+			metrics.ObserveFirstToken(r.Context())
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			flusher.Flush()
+		}
+	})
+
+	// 指标是进程级的，按调用前后的差值判断，-count=2 时同样成立
+	requests := metrics.RequestsTotal.WithLabelValues("/test/sse", "gpt-4o", "200")
+	chunks := metrics.SSEChunksTotal.WithLabelValues("/test/sse", "gpt-4o")
+	bytes := metrics.SSEBytesTotal.WithLabelValues("/test/sse", "gpt-4o")
+	requestsBefore, chunksBefore, bytesBefore := testutil.ToFloat64(requests), testutil.ToFloat64(chunks), testutil.ToFloat64(bytes)
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/sse", nil))
+
+	if got := testutil.ToFloat64(requests) - requestsBefore; got != 1 {
+		t.Errorf("expected 1 request, got %v", got)
+	}
+	if got := testutil.ToFloat64(chunks) - chunksBefore; got != 3 {
+		t.Errorf("expected 3 chunks, got %v", got)
+	}
+	if got := testutil.ToFloat64(bytes) - bytesBefore; got != float64(3*len("data: 0\n\n")) {
+		t.Errorf("unexpected byte count %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.TimeToFirstToken); got == 0 {
+		t.Error("expected time to first token to be observed")
+	}
+}
+
+func TestUnknownModelLabelIsBounded(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("hi"), fakemerlin.Done())
+
+	handler := metrics.Instrument("/v1/chat/completions", api.HandleChat)
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"my-custom-model-1234","messages":[{"role":"user","content":"hi"}]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	scrape := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := scrape.Body.String()
+	if strings.Contains(body, "my-custom-model-1234") {
+		t.Errorf("unknown model name leaked into metric labels")
+	}
+	if !strings.Contains(body, `merlin2api_http_requests_total{model="other",route="/v1/chat/completions",status="200"}`) {
+		t.Errorf("expected the request to be counted under model=\"other\"")
+	}
+	if !strings.Contains(body, `merlin2api_tokens_total{model="other",type="completion"}`) {
+		t.Errorf("expected token usage to be counted under model=\"other\"")
+	}
+}
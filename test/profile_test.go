@@ -0,0 +1,96 @@
+package test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/profile"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+func TestProfileHeaders(t *testing.T) {
+	cfg, err := profile.LoadConfig("")
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	h := http.Header{}
+	cfg.Select("").Apply(h)
+
+	// User-Agent 与 sec-ch-ua 必须来自同一个版本
+	if h.Get("User-Agent") == "" || h.Get("Sec-Ch-Ua") == "" {
+		t.Fatalf("missing browser headers: %v", h)
+	}
+	if h.Get("X-Merlin-Version") != "web-merlin" {
+		t.Errorf("unexpected x-merlin-version: %s", h.Get("X-Merlin-Version"))
+	}
+}
+
+func TestProfileBinding(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	config := `{
+		"version": "test",
+		"default": "a",
+		"profiles": [
+			{"name": "a", "brand": "Google Chrome", "version": "131", "osToken": "X11; Linux x86_64"},
+			{"name": "b", "brand": "Google Chrome", "version": "132", "osToken": "Windows NT 10.0; Win64; x64"}
+		],
+		"bindings": {"account-b": "b"}
+	}`
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatalf("write config failed: %v", err)
+	}
+
+	cfg, err := profile.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+
+	if p := cfg.Select("account-b"); p.Name != "b" {
+		t.Errorf("expected bound profile b, got %s", p.Name)
+	}
+
+	// 未绑定的账号每次都应得到同一个配置
+	first := cfg.Select("account-x")
+	for i := 0; i < 10; i++ {
+		if p := cfg.Select("account-x"); p.Name != first.Name {
+			t.Fatalf("profile for account-x changed from %s to %s", first.Name, p.Name)
+		}
+	}
+}
+
+func TestProfileMerlinVersionReachesUpstream(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Cleanup(profile.SetConfig(profile.Config{
+		Version:  "test",
+		Default:  "custom",
+		Profiles: []profile.Profile{{Name: "custom", Brand: "Google Chrome", Version: "131", MerlinVersion: "web-merlin-test"}},
+	}))
+
+	postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"model":    "gpt-4o",
+	})
+	data := pngImage(t)
+	postMultipart(t, api.HandleImageEdits, "/v1/images/edits",
+		map[string]string{"prompt": "add a hat"},
+		map[string]map[string][]byte{"image": {"cat.png": data}})
+
+	seen := map[string]bool{}
+	for _, r := range fake.Requests() {
+		switch r.Path {
+		case "/v1/thread/unified", "/v1/wallflower/unified-generation", "/v1/wallflower/upload":
+			seen[r.Path] = true
+			if got := r.Header.Get("X-Merlin-Version"); got != "web-merlin-test" {
+				t.Errorf("%s sent x-merlin-version %q, expected the profile's", r.Path, got)
+			}
+		}
+	}
+	if len(seen) != 3 {
+		t.Errorf("expected chat, upload and image requests, got %v", seen)
+	}
+}
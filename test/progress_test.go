@@ -0,0 +1,134 @@
+package test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+// chatImage 通过聊天接口调用画图模型
+func chatImage(t *testing.T) *httptest.ResponseRecorder {
+	t.Helper()
+	return postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "一只可爱的猫"}},
+		"stream":   true,
+		"model":    "flux-1.1-pro",
+	})
+}
+
+// chunkContents 返回每个块的内容
+func chunkContents(t *testing.T, body string) []string {
+	t.Helper()
+	var contents []string
+	for _, d := range streamData(body) {
+		if d == "[DONE]" {
+			continue
+		}
+		var chunk api.OpenAIStreamResponse
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("Invalid chunk %s: %v", d, err)
+		}
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			contents = append(contents, chunk.Choices[0].Delta.Content)
+		}
+	}
+	return contents
+}
+
+func TestImageProgressChunks(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptImage(
+		fakemerlin.Raw(`{"status":"queued"}`),
+		fakemerlin.Raw(`{"status":"processing","payload":[{"status":"generating","progress":40}]}`),
+		fakemerlin.Raw(`{"status":"processing","payload":[{"status":"generating","progress":40}]}`),
+		fakemerlin.Variations("https://cdn.example.com/a.png"),
+		fakemerlin.Raw(`{"status":"processing","payload":[{"status":"generating","progress":80}]}`),
+		fakemerlin.Raw(`{"status":"success","payload":[{"variations":[{"url":"https://cdn.example.com/b.png","iid":"iid-1","seed":1001}]}]}`),
+		fakemerlin.Raw("[DONE]"),
+	)
+
+	rec := chatImage(t)
+
+	want := []string{
+		"queued…\n",
+		"generating 40%…\n",
+		"\n生成的图片:\n1. ![image](https://cdn.example.com/a.png)",
+		"generating 80%…\n",
+		"\n2. ![image](https://cdn.example.com/b.png)",
+	}
+	got := chunkContents(t, rec.Body.String())
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected chunks:\n got %q\nwant %q", got, want)
+	}
+	if data := streamData(rec.Body.String()); data[len(data)-1] != "[DONE]" {
+		t.Errorf("stream should end with [DONE], got %v", data)
+	}
+}
+
+func TestImageChunksWithoutProgress(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	got := chunkContents(t, chatImage(t).Body.String())
+
+	want := []string{"生成的图片:\n1. ![image](https://cdn.example.com/image-0.png)", "\n2. ![image](https://cdn.example.com/image-1.png)"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected chunks:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestImageProgressIsFlushedBeforeImages(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	const delay = 500 * time.Millisecond
+	fake.ScriptImage(
+		fakemerlin.Raw(`{"status":"queued"}`),
+		delayed(fakemerlin.Variations("https://cdn.example.com/a.png"), delay),
+		fakemerlin.Raw("[DONE]"),
+	)
+	server := httptest.NewServer(http.HandlerFunc(api.HandleChat))
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := http.Post(server.URL+"/v1/chat/completions", "application/json",
+		strings.NewReader(`{"model":"flux-1.1-pro","stream":true,"messages":[{"role":"user","content":"一只可爱的猫"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "queued") {
+			if elapsed := time.Since(start); elapsed >= delay {
+				t.Errorf("progress arrived after %v, expected it before the image", elapsed)
+			}
+			return
+		}
+	}
+	t.Fatal("progress chunk was not streamed")
+}
+
+func TestImageErrorAfterProgress(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptImage(fakemerlin.Raw(`{"status":"queued"}`), fakemerlin.Error("CONTENT_POLICY", "prompt was flagged"))
+
+	rec := chatImage(t)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("errors after progress must be sent in the stream, got %d", rec.Code)
+	}
+	data := streamData(rec.Body.String())
+	if len(data) != 2 || !strings.Contains(data[0], "queued") || !strings.Contains(data[1], "content_policy_violation") {
+		t.Errorf("expected the progress chunk followed by a stream error, got %v", data)
+	}
+}
@@ -0,0 +1,224 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+// streamedContent 提取 SSE 响应中所有内容块拼接后的文本
+func streamedContent(t *testing.T, body string) string {
+	t.Helper()
+	var content strings.Builder
+	for _, d := range streamData(body) {
+		if d == "[DONE]" {
+			continue
+		}
+		var chunk api.OpenAIStreamResponse
+		if err := json.Unmarshal([]byte(d), &chunk); err != nil {
+			t.Fatalf("Invalid chunk %s: %v", d, err)
+		}
+		for _, choice := range chunk.Choices {
+			content.WriteString(choice.Delta.Content)
+		}
+	}
+	return content.String()
+}
+
+func TestRecordAndReplayChat(t *testing.T) {
+	dir := t.TempDir()
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("recorded "), fakemerlin.Content("answer"), fakemerlin.Done())
+
+	cfg := upstream.ConfigFromEnv()
+	cfg.RecordDir = dir
+	restore := upstream.SetClient(newUpstreamClient(t, cfg))
+	defer restore()
+
+	request := map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	}
+	recorded := streamedContent(t, postChat(t, request).Body.String())
+	if recorded != "recorded answer" {
+		t.Fatalf("unexpected recorded content %q", recorded)
+	}
+
+	// fixture 中不能出现任何凭据
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("expected session and chat fixtures, got %v", files)
+	}
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, secret := range []string{fake.SessionToken, fake.AccessToken, "Fake User"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s leaks secret %q", filepath.Base(file), secret)
+			}
+		}
+	}
+
+	// 关闭假上游后从 fixture 回放
+	fake.Close()
+	cfg = upstream.ConfigFromEnv()
+	cfg.ReplayDir = dir
+	upstream.SetClient(newUpstreamClient(t, cfg))
+
+	replayed := streamedContent(t, postChat(t, request).Body.String())
+	if replayed != recorded {
+		t.Errorf("replayed content %q differs from recorded %q", replayed, recorded)
+	}
+}
+
+func TestRecordRedactsCookiesAndKeepsBinaryBodies(t *testing.T) {
+	dir := t.TempDir()
+	binary := []byte{0x89, 'P', 'N', 'G', 0xff, 0xfe, 0x00, 0x01}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "cookie-secret", Path: "/", HttpOnly: true})
+		w.Header().Add("Set-Cookie", "theme=dark-secret")
+		if r.URL.Path == "/image" {
+			w.Write(binary)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"user":{"name":"Jane Doe","displayName":"Jane","picture":"https://example.com/jane.png","plan":"pro"}}`))
+	}))
+	defer server.Close()
+
+	cfg := upstream.ConfigFromEnv()
+	cfg.RecordDir = dir
+	client := newUpstreamClient(t, cfg)
+	for _, path := range []string{"/profile", "/image"} {
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(binary))
+		req.Header.Set("Cookie", "a=cookie-secret; b=other-secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 fixtures, got %v", files)
+	}
+	var exchanges []upstream.Exchange
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		for _, secret := range []string{"cookie-secret", "other-secret", "dark-secret", "Jane", "jane.png"} {
+			if strings.Contains(string(data), secret) {
+				t.Errorf("%s leaks %q", filepath.Base(file), secret)
+			}
+		}
+		var exchange upstream.Exchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			t.Fatal(err)
+		}
+		exchanges = append(exchanges, exchange)
+	}
+
+	profile := exchanges[0]
+	if got := profile.Request.Header.Get("Cookie"); got != "a=REDACTED; b=REDACTED" {
+		t.Errorf("unexpected Cookie %q", got)
+	}
+	if got := profile.Response.Header.Values("Set-Cookie"); len(got) != 2 || got[0] != "sid=REDACTED; Path=/; HttpOnly" || got[1] != "theme=REDACTED" {
+		t.Errorf("unexpected Set-Cookie %q", got)
+	}
+	if !strings.Contains(profile.Response.Body, `"plan":"pro"`) {
+		t.Errorf("non-sensitive fields should be kept: %s", profile.Response.Body)
+	}
+
+	image := exchanges[1]
+	if image.Request.BodyEncoding != "base64" || image.Response.BodyEncoding != "base64" {
+		t.Fatalf("binary bodies should be stored as base64, got %q and %q", image.Request.BodyEncoding, image.Response.BodyEncoding)
+	}
+	if body, err := image.ResponseBody(); err != nil || !bytes.Equal(body, binary) {
+		t.Errorf("binary body was not preserved: %v %v", body, err)
+	}
+
+	// 回放时返回原始字节
+	replay, err := upstream.NewReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/image", nil)
+	resp, err := (&http.Client{Transport: replay}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); !bytes.Equal(body, binary) {
+		t.Errorf("replayed body %v differs from recorded %v", body, binary)
+	}
+}
+
+func TestReplayImageFixture(t *testing.T) {
+	t.Setenv("MERLIN_SESSION_TOKEN", "fixture-session-token")
+
+	replay, err := upstream.NewReplayTransport(filepath.Join("testdata", "replay", "image-generation"))
+	if err != nil {
+		t.Fatalf("load fixtures failed: %v", err)
+	}
+	restore := upstream.SetClient(&http.Client{Transport: replay})
+	defer restore()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(`{"prompt":"a cat","model":"flux-1.1-pro"}`))
+	api.HandleImageGenerations(rec, req)
+
+	body := rec.Body.String()
+	for _, url := range []string{"https://cdn.example.com/image-0.png", "https://cdn.example.com/image-1.png"} {
+		if !strings.Contains(body, url) {
+			t.Errorf("expected %s in response: %s", url, body)
+		}
+	}
+}
+
+// TestCommittedFixturesAreRedacted 检查提交的 fixture 与录制器的脱敏格式一致：Cookie 保留名称、值为 REDACTED
+func TestCommittedFixturesAreRedacted(t *testing.T) {
+	files, _ := filepath.Glob(filepath.Join("testdata", "replay", "*", "*.json"))
+	if len(files) == 0 {
+		t.Fatal("no committed fixtures found")
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var exchange upstream.Exchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+
+		var cookies []string
+		for _, value := range exchange.Request.Header.Values("Cookie") {
+			cookies = append(cookies, strings.Split(value, "; ")...)
+		}
+		for _, value := range exchange.Response.Header.Values("Set-Cookie") {
+			first, _, _ := strings.Cut(value, ";")
+			cookies = append(cookies, first)
+		}
+		for _, cookie := range cookies {
+			name, value, ok := strings.Cut(cookie, "=")
+			if !ok || name == "" || value != "REDACTED" {
+				t.Errorf("%s: cookie %q should be recorded as name=REDACTED", filepath.Base(file), cookie)
+			}
+		}
+		if auth := exchange.Request.Header.Get("Authorization"); auth != "" && auth != "REDACTED" {
+			t.Errorf("%s: Authorization is not redacted", filepath.Base(file))
+		}
+	}
+}
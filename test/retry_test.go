@@ -0,0 +1,164 @@
+package test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+// threadRequests 返回假上游收到的 thread/unified 请求
+func threadRequests(fake *fakemerlin.Server) []fakemerlin.Request {
+	var requests []fakemerlin.Request
+	for _, r := range fake.Requests() {
+		if r.Path == "/v1/thread/unified" {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := upstream.RetryPolicy{MaxRetries: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for i := 0; i < 20; i++ {
+		if d := policy.Backoff(1); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("first backoff out of range: %s", d)
+		}
+		if d := policy.Backoff(3); d < 200*time.Millisecond || d > 400*time.Millisecond {
+			t.Fatalf("third backoff out of range: %s", d)
+		}
+		if d := policy.Backoff(10); d > time.Second {
+			t.Fatalf("backoff exceeds max delay: %s", d)
+		}
+	}
+}
+
+func TestRetryOnServerError(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("MERLIN_RETRY_BASE_DELAY", "1ms")
+	fake.Fail("/v1/thread/unified", http.StatusServiceUnavailable, `{"error":"busy"}`)
+	fake.Fail("/v1/thread/unified", http.StatusTooManyRequests, `{"error":"slow down"}`)
+	fake.ScriptChat(fakemerlin.Content("recovered"), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"model":    "gpt-4o",
+	})
+
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "recovered") {
+		t.Fatalf("expected retried request to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := len(threadRequests(fake)); n != 3 {
+		t.Errorf("expected 3 upstream attempts, got %d", n)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("MERLIN_RETRY_BASE_DELAY", "1ms")
+	fake.Fail("/v1/thread/unified", http.StatusBadRequest, `{"error":"bad request"}`)
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"model":    "gpt-4o",
+	})
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rec.Code)
+	}
+	if n := len(threadRequests(fake)); n != 1 {
+		t.Errorf("client errors must not be retried, got %d attempts", n)
+	}
+}
+
+func TestFailoverToBackupAccount(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	backupSession, backupAccess := fake.AddAccount("backup")
+	t.Setenv("MERLIN_BACKUP_SESSION_TOKENS", backupSession)
+	t.Setenv("MERLIN_RETRY_BASE_DELAY", "1ms")
+	fake.Fail("/v1/thread/unified", http.StatusBadGateway, `{"error":"bad gateway"}`)
+	fake.ScriptChat(fakemerlin.Content("from backup"), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	if got := streamedContent(t, rec.Body.String()); got != "from backup" {
+		t.Fatalf("unexpected content %q", got)
+	}
+	requests := threadRequests(fake)
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 upstream attempts, got %d", len(requests))
+	}
+	if auth := requests[0].Header.Get("Authorization"); auth != "Bearer "+fake.AccessToken {
+		t.Errorf("first attempt should use the primary account, got %s", auth)
+	}
+	if auth := requests[1].Header.Get("Authorization"); auth != "Bearer "+backupAccess {
+		t.Errorf("retry should fail over to the backup account, got %s", auth)
+	}
+}
+
+func TestStreamContinueAfterBreak(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	t.Setenv("MERLIN_STREAM_CONTINUE", "true")
+	fake.ScriptChat(fakemerlin.Content("The quick brown fox "), fakemerlin.Abort())
+	fake.ScriptChat(fakemerlin.Content("brown fox jumps over "), fakemerlin.Content("the lazy dog."), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "tell me about the fox"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	data := streamData(rec.Body.String())
+	if len(data) == 0 || data[len(data)-1] != "[DONE]" {
+		t.Fatalf("continued stream must end with [DONE]: %v", data)
+	}
+	if got := streamedContent(t, rec.Body.String()); got != "The quick brown fox jumps over the lazy dog." {
+		t.Errorf("unexpected spliced content %q", got)
+	}
+
+	requests := threadRequests(fake)
+	if len(requests) != 2 {
+		t.Fatalf("expected a continuation request, got %d requests", len(requests))
+	}
+	var continuation api.MerlinRequest
+	json.Unmarshal(requests[1].Body, &continuation)
+	if !strings.Contains(continuation.Message.Content, "tell me about the fox") || !strings.Contains(continuation.Message.Content, "The quick brown fox ") {
+		t.Errorf("continuation should include the question and the partial answer: %s", continuation.Message.Content)
+	}
+}
+
+func TestStreamBreakWithoutContinue(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("partial"), fakemerlin.Abort())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+
+	data := streamData(rec.Body.String())
+	if len(data) == 0 {
+		t.Fatal("empty stream")
+	}
+	if resp := decodeError(t, data[len(data)-1]); resp.Error.Type != "server_error" {
+		t.Errorf("expected a final error event, got %s", data[len(data)-1])
+	}
+	if n := len(threadRequests(fake)); n != 1 {
+		t.Errorf("streams must not be retried after content was sent, got %d requests", n)
+	}
+}
@@ -0,0 +1,191 @@
+package test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/sse"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+)
+
+func decodeAll(t *testing.T, input string) []sse.Event {
+	t.Helper()
+	decoder := sse.NewDecoder(strings.NewReader(input))
+	var events []sse.Event
+	for decoder.Next() {
+		events = append(events, decoder.Event())
+	}
+	if err := decoder.Err(); err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	return events
+}
+
+func TestSSEDecoder(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []sse.Event
+	}{
+		{
+			name:  "single data",
+			input: "data: hello\n\n",
+			want:  []sse.Event{{Event: "message", Data: "hello"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: first\ndata: second\n\n",
+			want:  []sse.Event{{Event: "message", Data: "first\nsecond"}},
+		},
+		{
+			name:  "event id and retry",
+			input: "event: progress\nid: 7\nretry: 1500\ndata: {}\n\n",
+			want:  []sse.Event{{ID: "7", Event: "progress", Data: "{}", Retry: 1500 * time.Millisecond}},
+		},
+		{
+			name:  "comments are ignored",
+			input: ": ping\n\ndata: a\n: inline\ndata: b\n\n",
+			want:  []sse.Event{{Event: "message", Data: "a\nb"}},
+		},
+		{
+			name:  "CRLF and CR line endings",
+			input: "data: a\r\n\r\ndata: b\r\rdata: c\n\n",
+			want: []sse.Event{
+				{Event: "message", Data: "a"},
+				{Event: "message", Data: "b"},
+				{Event: "message", Data: "c"},
+			},
+		},
+		{
+			name:  "no space after colon and field without colon",
+			input: "data:tight\ndata\n\n",
+			want:  []sse.Event{{Event: "message", Data: "tight\n"}},
+		},
+		{
+			name:  "only the first space is stripped",
+			input: "data:  padded\n\n",
+			want:  []sse.Event{{Event: "message", Data: " padded"}},
+		},
+		{
+			name:  "event without data is not dispatched",
+			input: "event: empty\n\ndata: next\n\n",
+			want:  []sse.Event{{Event: "message", Data: "next"}},
+		},
+		{
+			name:  "id persists across events",
+			input: "id: 1\ndata: a\n\ndata: b\n\n",
+			want:  []sse.Event{{ID: "1", Event: "message", Data: "a"}, {ID: "1", Event: "message", Data: "b"}},
+		},
+		{
+			name:  "invalid retry is ignored",
+			input: "retry: soon\ndata: a\n\n",
+			want:  []sse.Event{{Event: "message", Data: "a"}},
+		},
+		{
+			name:  "trailing event without blank line",
+			input: "data: a\n\ndata: [DONE]",
+			want:  []sse.Event{{Event: "message", Data: "a"}, {Event: "message", Data: "[DONE]"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeAll(t, tt.input)
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %d events, got %d: %+v", len(tt.want), len(got), got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("event %d: expected %+v, got %+v", i, tt.want[i], got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSSEDecoderLargeEvent(t *testing.T) {
+	payload := strings.Repeat("x", 4<<20)
+	events := decodeAll(t, "data: "+payload+"\n\n")
+	if len(events) != 1 || events[0].Data != payload {
+		t.Fatalf("large event was not decoded intact")
+	}
+}
+
+func TestSSEWriteRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	event := sse.Event{ID: "42", Event: "update", Data: "line one\nline two", Retry: time.Second}
+	if err := sse.Write(&buf, event); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := sse.WriteComment(&buf, "ping"); err != nil {
+		t.Fatalf("write comment failed: %v", err)
+	}
+
+	events := decodeAll(t, buf.String())
+	if len(events) != 1 || events[0] != event {
+		t.Fatalf("expected %+v, got %+v", event, events)
+	}
+
+	if err := sse.Write(&buf, sse.Event{Event: "bad\nname"}); err == nil {
+		t.Error("expected error for event name containing newline")
+	}
+}
+
+func TestChatStreamLargeEvent(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	large := strings.Repeat("长", 100*1024)
+	fake.ScriptChat(fakemerlin.Content(large), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"stream":   true,
+		"model":    "gpt-4o",
+	})
+	if got := streamedContent(t, rec.Body.String()); got != large {
+		t.Fatalf("expected %d bytes of content, got %d", len(large), len(got))
+	}
+}
+
+func FuzzSSEDecoder(f *testing.F) {
+	f.Add("data: hello\n\n")
+	f.Add("event: a\r\nid: 1\r\nretry: 10\r\ndata: x\r\ndata: y\r\n\r\n")
+	f.Add(": comment\rdata\r\r")
+	f.Add("data: [DONE]")
+
+	f.Fuzz(func(t *testing.T, input string) {
+		decoder := sse.NewDecoder(strings.NewReader(input))
+		for decoder.Next() {
+			event := decoder.Event()
+			if event.Event == "" {
+				t.Fatalf("dispatched event without type")
+			}
+			if strings.ContainsAny(event.ID+event.Event, "\r\n") {
+				t.Fatalf("field contains line terminator: %+v", event)
+			}
+		}
+		if err := decoder.Err(); err != nil {
+			t.Fatalf("unexpected error from in-memory reader: %v", err)
+		}
+	})
+}
+
+func FuzzSSERoundTrip(f *testing.F) {
+	f.Add("hello")
+	f.Add("multi\nline\r\ndata\r")
+	f.Add("")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		var buf bytes.Buffer
+		if err := sse.Write(&buf, sse.Event{Data: data}); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		events := decodeAll(t, buf.String())
+		want := strings.ReplaceAll(strings.ReplaceAll(data, "\r\n", "\n"), "\r", "\n")
+		if len(events) != 1 || events[0].Data != want {
+			t.Fatalf("round trip of %q produced %+v", data, events)
+		}
+	})
+}
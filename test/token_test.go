@@ -4,10 +4,15 @@ import (
 	"testing"
 
 	"github.com/rubleowen/GetMerlin2Api/auth"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
 	"github.com/rubleowen/GetMerlin2Api/utils"
 )
 
 func TestRefreshAuthToken(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	auth.ClearTokenCache()
+
 	// 从环境变量获取refresh token
 	refreshToken := utils.GetEnvOrDefault("MERLIN_REFRESH_TOKEN", "")
 	if refreshToken == "" {
@@ -34,3 +39,20 @@ func TestRefreshAuthToken(t *testing.T) {
 		t.Error("Token should start with 'Bearer '")
 	}
 }
+
+func TestGetSessionToken(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	token, err := auth.GetSessionToken(fake.SessionToken)
+	if err != nil {
+		t.Fatalf("GetSessionToken failed: %v", err)
+	}
+	if token != fake.AccessToken {
+		t.Errorf("Expected %s, got %s", fake.AccessToken, token)
+	}
+
+	if _, err := auth.GetSessionToken("wrong-session-token"); err == nil {
+		t.Error("Expected an error for an invalid session token")
+	}
+}
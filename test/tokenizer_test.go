@@ -0,0 +1,71 @@
+package test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+	"github.com/rubleowen/GetMerlin2Api/tokenizer"
+)
+
+func TestTokenizerForModel(t *testing.T) {
+	tests := map[string]tokenizer.Encoding{
+		"gpt-4o":            tokenizer.O200K,
+		"gpt-4o-64k-output": tokenizer.O200K,
+		"o1-mini":           tokenizer.O200K,
+		"gpt-4":             tokenizer.CL100K,
+		"gpt-3.5-turbo":     tokenizer.CL100K,
+		"claude-3-haiku":    tokenizer.CL100K,
+	}
+	for model, want := range tests {
+		if got := tokenizer.ForModel(model); got != want {
+			t.Errorf("%s: expected %s, got %s", model, want, got)
+		}
+	}
+}
+
+func TestTokenizerCount(t *testing.T) {
+	// 参考值是 tiktoken 的大致计数，估算值允许 25% 的误差
+	tests := []struct {
+		text     string
+		encoding tokenizer.Encoding
+		want     int
+	}{
+		{"Hello, world", tokenizer.CL100K, 3},
+		{"The quick brown fox jumps over the lazy dog.", tokenizer.CL100K, 10},
+		{"The quick brown fox jumps over the lazy dog.", tokenizer.O200K, 10},
+		{"func main() {\n\tfmt.Println(\"hi\")\n}", tokenizer.CL100K, 11},
+		{"今天天气很好，我们去公园散步吧。", tokenizer.CL100K, 19},
+		{"今天天气很好，我们去公园散步吧。", tokenizer.O200K, 11},
+	}
+	for _, tt := range tests {
+		got := tt.encoding.Count(tt.text)
+		if diff := got - tt.want; diff*4 > tt.want || -diff*4 > tt.want {
+			t.Errorf("%s %q: expected about %d tokens, got %d", tt.encoding, tt.text, tt.want, got)
+		}
+	}
+	if n := tokenizer.O200K.Count(""); n != 0 {
+		t.Errorf("empty text should have 0 tokens, got %d", n)
+	}
+}
+
+func TestChatCompletionUsage(t *testing.T) {
+	fake := fakemerlin.New()
+	fake.Use(t)
+	fake.ScriptChat(fakemerlin.Content("Hello, world"), fakemerlin.Done())
+
+	rec := postChat(t, map[string]interface{}{
+		"messages": []map[string]string{{"role": "user", "content": "hi"}},
+		"model":    "gpt-4o",
+	})
+
+	var response api.ChatCompletion
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Invalid response %s: %v", rec.Body.String(), err)
+	}
+	want := api.Usage{PromptTokens: 8, CompletionTokens: 3, TotalTokens: 11}
+	if response.Usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, response.Usage)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rubleowen/GetMerlin2Api/api"
+	"github.com/rubleowen/GetMerlin2Api/test/fakemerlin"
+	"github.com/rubleowen/GetMerlin2Api/tracing"
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// useSpanRecorder 在测试期间把 span 记录到内存中
+func useSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	if _, err := tracing.Init(context.Background()); err != nil {
+		t.Fatalf("Init failed: %v", err)
+	}
+	return recorder
+}
+
+func TestUpstreamSpansWithoutTraceparent(t *testing.T) {
+	recorder := useSpanRecorder(t)
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+
+	ctx, span := tracing.Start(context.Background(), "test.parent", tracing.AttrModel.String("gpt-4o"))
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := newUpstreamClient(t, upstream.ConfigFromEnv()).Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	tracing.End(span, nil)
+
+	// 上游请求不能带上 traceparent，否则不像浏览器发出的请求
+	if traceparent != "" {
+		t.Errorf("traceparent leaked to upstream: %s", traceparent)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	client, parent := spans[0], spans[1]
+	if client.Parent().SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("upstream span is not a child of the request span")
+	}
+}
+
+func TestInboundTraceparentIsParent(t *testing.T) {
+	recorder := useSpanRecorder(t)
+	fake := fakemerlin.New()
+	fake.Use(t)
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		remoteSpanID = "00f067aa0ba902b7"
+	)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-"+remoteSpanID+"-01")
+	tracing.Handler("/v1/chat/completions", http.HandlerFunc(api.HandleChat)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	server, thread := spans["POST /v1/chat/completions"], spans["merlin.thread.unified"]
+	if server == nil || thread == nil {
+		t.Fatalf("missing spans, got %v", spans)
+	}
+	if got := server.Parent(); !got.IsRemote() || got.TraceID().String() != traceID || got.SpanID().String() != remoteSpanID {
+		t.Errorf("server span parent is %v, expected the inbound traceparent", got)
+	}
+	if thread.SpanContext().TraceID().String() != traceID || thread.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("merlin.thread.unified should continue the inbound trace under the server span, got parent %v", thread.Parent())
+	}
+
+	// 入站的 traceparent 同样不能转发给上游
+	for _, r := range fake.Requests() {
+		if tp := r.Header.Get("traceparent"); tp != "" {
+			t.Errorf("traceparent leaked to %s: %s", r.Path, tp)
+		}
+	}
+}
+
+func TestServerSpanNamedAfterRoute(t *testing.T) {
+	recorder := useSpanRecorder(t)
+
+	rec := httptest.NewRecorder()
+	tracing.Handler("/", http.HandlerFunc(api.HandleChat)).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/unknown/12345", nil))
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if name := spans[0].Name(); name != "POST /" {
+		t.Errorf("span name should use the registered route, got %q", name)
+	}
+	attrs := map[attribute.Key]string{}
+	for _, kv := range spans[0].Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs["url.path"] != "/v1/unknown/12345" || attrs["http.route"] != "/" {
+		t.Errorf("expected url.path to hold the raw path and http.route the route, got %v", attrs)
+	}
+}
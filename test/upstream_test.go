@@ -0,0 +1,131 @@
+package test
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/upstream"
+)
+
+// newUpstreamClient 创建上游客户端，失败时结束测试
+func newUpstreamClient(tb testing.TB, cfg upstream.Config) *http.Client {
+	tb.Helper()
+	client, err := upstream.New(cfg)
+	if err != nil {
+		tb.Fatalf("upstream.New failed: %v", err)
+	}
+	return client
+}
+
+func newTLSUpstream() *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"status\":\"system\",\"data\":{\"eventType\":\"DONE\"}}\n\n")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	return server
+}
+
+func testConfig(server *httptest.Server) upstream.Config {
+	cfg := upstream.ConfigFromEnv()
+	cfg.TLSClientConfig = &tls.Config{RootCAs: server.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs}
+	return cfg
+}
+
+func doRequest(b *testing.B, client *http.Client, url string) {
+	resp, err := client.Get(url)
+	if err != nil {
+		b.Fatalf("request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// BenchmarkFreshClient 模拟原先每个请求新建 Transport 的做法
+func BenchmarkFreshClient(b *testing.B) {
+	server := newTLSUpstream()
+	defer server.Close()
+	cfg := testConfig(server)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client := newUpstreamClient(b, cfg)
+		doRequest(b, client, server.URL)
+		client.CloseIdleConnections()
+	}
+}
+
+// BenchmarkSharedClient 复用同一个客户端的连接
+func BenchmarkSharedClient(b *testing.B) {
+	server := newTLSUpstream()
+	defer server.Close()
+	client := newUpstreamClient(b, testConfig(server))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doRequest(b, client, server.URL)
+	}
+}
+
+func TestSharedClientUsesHTTP2(t *testing.T) {
+	server := newTLSUpstream()
+	defer server.Close()
+	client := newUpstreamClient(t, testConfig(server))
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		// 之后上游保持静默
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	cfg := upstream.ConfigFromEnv()
+	cfg.StreamIdleTimeout = 100 * time.Millisecond
+	client := newUpstreamClient(t, cfg)
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	start := time.Now()
+	_, err = io.ReadAll(resp.Body)
+	if !errors.Is(err, upstream.ErrStreamIdle) {
+		t.Fatalf("expected ErrStreamIdle, got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("idle timeout took too long: %v", time.Since(start))
+	}
+}
+
+func TestNewReturnsReplayFixtureError(t *testing.T) {
+	cfg := upstream.ConfigFromEnv()
+	cfg.ReplayDir = t.TempDir()
+
+	if client, err := upstream.New(cfg); err == nil || client != nil {
+		t.Fatalf("expected an error for a replay directory without fixtures, got %v", err)
+	}
+}
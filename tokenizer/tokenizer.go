@@ -0,0 +1,113 @@
+// Package tokenizer 离线估算文本的 token 数。按 tiktoken 的 cl100k_base 和 o200k_base
+// 的预分词规则切分文本，再按各编码的平均压缩率估算每一段的 token 数，不需要下载词表。
+package tokenizer
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Encoding 模型使用的编码
+type Encoding int
+
+const (
+	// CL100K gpt-4、gpt-3.5 以及非 OpenAI 模型的近似
+	CL100K Encoding = iota
+	// O200K gpt-4o、gpt-4.1 和 o 系列推理模型
+	O200K
+)
+
+func (e Encoding) String() string {
+	if e == O200K {
+		return "o200k_base"
+	}
+	return "cl100k_base"
+}
+
+// o200kPrefixes 使用 o200k_base 的模型名前缀
+var o200kPrefixes = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "chatgpt-4o", "o1", "o3", "o4"}
+
+// ForModel 返回模型对应的编码，未知模型按 cl100k_base 估算
+func ForModel(model string) Encoding {
+	model = strings.ToLower(model)
+	for _, prefix := range o200kPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return O200K
+		}
+	}
+	return CL100K
+}
+
+// pretokenize 与 tiktoken 的预分词规则一致（Go 的正则不支持前瞻，末尾空白的归属略有差异）
+var pretokenize = regexp.MustCompile(`(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// ratio 每种编码的平均压缩率
+type ratio struct {
+	// wordRunes 拉丁字母单词平均每个 token 的字符数
+	wordRunes int
+	// cjkPerFour 每四个汉字、假名或韩文字符大约的 token 数
+	cjkPerFour int
+	// symbolRunes 标点符号平均每个 token 的字符数
+	symbolRunes int
+}
+
+var ratios = map[Encoding]ratio{
+	CL100K: {wordRunes: 5, cjkPerFour: 5, symbolRunes: 2},
+	O200K:  {wordRunes: 6, cjkPerFour: 3, symbolRunes: 3},
+}
+
+// Count 估算 text 的 token 数
+func (e Encoding) Count(text string) int {
+	r := ratios[e]
+	total := 0
+	for _, piece := range pretokenize.FindAllString(text, -1) {
+		total += r.piece(piece)
+	}
+	return total
+}
+
+func (r ratio) piece(piece string) int {
+	trimmed := strings.TrimLeftFunc(piece, unicode.IsSpace)
+	if trimmed == "" {
+		return 1
+	}
+	first, _ := utf8.DecodeRuneInString(trimmed)
+	switch {
+	case unicode.IsNumber(first):
+		return 1
+	case hasLetter(trimmed):
+		return r.word(trimmed)
+	}
+	return ceilDiv(utf8.RuneCountInString(strings.TrimRight(trimmed, "\r\n")), r.symbolRunes)
+}
+
+// word 汉字等表意文字按字数估算，其余按字母数估算，至少 1 个 token
+func (r ratio) word(word string) int {
+	cjk, other := 0, 0
+	for _, c := range word {
+		if isCJK(c) {
+			cjk++
+		} else {
+			other++
+		}
+	}
+	n := ceilDiv(cjk*r.cjkPerFour, 4) + ceilDiv(other, r.wordRunes)
+	if n == 0 {
+		return 1
+	}
+	return n
+}
+
+func hasLetter(s string) bool {
+	return strings.IndexFunc(s, unicode.IsLetter) >= 0
+}
+
+func isCJK(c rune) bool {
+	return unicode.In(c, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,88 @@
+package tracing
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/rubleowen/GetMerlin2Api"
+
+// 统一的 span 属性名
+var (
+	AttrModel   = attribute.Key("merlin.model")
+	AttrAccount = attribute.Key("merlin.account")
+)
+
+// Init 配置 W3C traceparent 传播，并在设置了 OTEL_EXPORTER_OTLP_ENDPOINT 时通过 OTLP/HTTP 导出 trace。
+// 返回的函数用于在退出前刷新未导出的 span
+func Init(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	endpoint := utils.GetEnvOrDefault("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", utils.GetEnvOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+	if endpoint == "" {
+		log.Printf("Tracing disabled: OTEL_EXPORTER_OTLP_ENDPOINT is not set")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// otlptracehttp 会自行读取 OTEL_EXPORTER_OTLP_* 环境变量
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(utils.GetEnvOrDefault("OTEL_SERVICE_NAME", "getmerlin2api")),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Tracing enabled, exporting to %s", endpoint)
+	return provider.Shutdown, nil
+}
+
+// Handler 为路由创建服务端 span，请求带有 traceparent 时作为它的子 span。
+// span 名使用注册时的路由避免名称随路径增长，实际路径记录在 url.path 属性中
+func Handler(route string, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace.SpanFromContext(r.Context()).SetAttributes(semconv.HTTPRoute(route), semconv.URLPath(r.URL.Path))
+		next.ServeHTTP(w, r)
+	}), route,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return r.Method + " " + route
+		}),
+	)
+}
+
+// Start 开始一个 span
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End 结束 span，err 不为空时记录为错误
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
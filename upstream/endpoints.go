@@ -0,0 +1,22 @@
+package upstream
+
+import (
+	"strings"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// SessionURL 返回 session 服务地址，可通过 MERLIN_SESSION_URL 覆盖（测试时指向假上游）
+func SessionURL() string {
+	return strings.TrimSuffix(utils.GetEnvOrDefault("MERLIN_SESSION_URL", "https://session.getmerlin.in"), "/")
+}
+
+// UAMURL 返回 UAM 服务地址，可通过 MERLIN_UAM_URL 覆盖
+func UAMURL() string {
+	return strings.TrimSuffix(utils.GetEnvOrDefault("MERLIN_UAM_URL", "https://uam.getmerlin.in"), "/")
+}
+
+// ArcaneURL 返回 arcane 服务地址，可通过 MERLIN_ARCANE_URL 覆盖
+func ArcaneURL() string {
+	return strings.TrimSuffix(utils.GetEnvOrDefault("MERLIN_ARCANE_URL", "https://arcane.getmerlin.in"), "/")
+}
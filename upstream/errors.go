@@ -0,0 +1,24 @@
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StatusError 上游返回了非 2xx 状态码，保留状态码和响应体供调用方映射错误
+type StatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+// NewStatusError 根据响应构造 StatusError，body 为已经读出的响应体
+func NewStatusError(resp *http.Response, body []byte) *StatusError {
+	return &StatusError{StatusCode: resp.StatusCode, Body: body}
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Body) == 0 {
+		return fmt.Sprintf("upstream returned status %d", e.StatusCode)
+	}
+	return string(e.Body)
+}
@@ -0,0 +1,246 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+const redacted = "REDACTED"
+
+// base64Encoding 非 UTF-8 的请求体或响应体以 base64 保存
+const base64Encoding = "base64"
+
+// 需要脱敏的请求头和 JSON 字段（不区分大小写）。Cookie 只保留名称，账号的个人信息与凭据一样脱敏
+var (
+	secretHeaders = []string{"Authorization"}
+	secretFields  = map[string]bool{
+		"token":        true,
+		"accesstoken":  true,
+		"refreshtoken": true,
+		"idtoken":      true,
+		"sessiontoken": true,
+		"cookie":       true,
+		"email":        true,
+		"name":         true,
+		"displayname":  true,
+		"firstname":    true,
+		"lastname":     true,
+		"username":     true,
+		"phone":        true,
+		"phonenumber":  true,
+		"picture":      true,
+		"photourl":     true,
+		"avatar":       true,
+	}
+	unsafeChars = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+)
+
+// Exchange 一次上游请求/响应，作为 fixture 文件保存。BodyEncoding 为 base64 时 Body 是 base64 编码的原始字节
+type Exchange struct {
+	Request struct {
+		Method       string      `json:"method"`
+		URL          string      `json:"url"`
+		Header       http.Header `json:"header"`
+		Body         string      `json:"body,omitempty"`
+		BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	} `json:"request"`
+	Response struct {
+		Status       int         `json:"status"`
+		Header       http.Header `json:"header"`
+		Body         string      `json:"body"`
+		BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	} `json:"response"`
+}
+
+// ResponseBody 返回录制的原始响应体
+func (e *Exchange) ResponseBody() ([]byte, error) {
+	if e.Response.BodyEncoding == base64Encoding {
+		return base64.StdEncoding.DecodeString(e.Response.Body)
+	}
+	return []byte(e.Response.Body), nil
+}
+
+// recordTransport 把经过的请求和响应脱敏后写入 dir，响应体在读完或关闭时落盘
+type recordTransport struct {
+	base http.RoundTripper
+	dir  string
+	seq  atomic.Int64
+}
+
+func newRecordTransport(base http.RoundTripper, dir string) *recordTransport {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("Warning: create record dir failed: %v", err)
+	}
+	return &recordTransport{base: base, dir: dir}
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil {
+		var err error
+		reqBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	var exchange Exchange
+	exchange.Request.Method = req.Method
+	exchange.Request.URL = req.URL.String()
+	exchange.Request.Header = redactHeader(req.Header)
+	exchange.Request.Body, exchange.Request.BodyEncoding = redactBody(reqBody)
+	exchange.Response.Status = resp.StatusCode
+	exchange.Response.Header = redactHeader(resp.Header)
+
+	name := fmt.Sprintf("%04d-%s-%s.json", t.seq.Add(1), req.Method, strings.Trim(unsafeChars.ReplaceAllString(req.URL.Host+req.URL.Path, "-"), "-"))
+	resp.Body = &recordBody{rc: resp.Body, exchange: &exchange, path: filepath.Join(t.dir, name)}
+	return resp, nil
+}
+
+type recordBody struct {
+	rc       io.ReadCloser
+	buf      bytes.Buffer
+	exchange *Exchange
+	path     string
+	once     sync.Once
+}
+
+func (b *recordBody) Read(p []byte) (int, error) {
+	n, err := b.rc.Read(p)
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.save()
+	}
+	return n, err
+}
+
+func (b *recordBody) Close() error {
+	b.save()
+	return b.rc.Close()
+}
+
+func (b *recordBody) save() {
+	b.once.Do(func() {
+		b.exchange.Response.Body, b.exchange.Response.BodyEncoding = redactBody(b.buf.Bytes())
+		data, err := json.MarshalIndent(b.exchange, "", "  ")
+		if err != nil {
+			log.Printf("Warning: marshal exchange failed: %v", err)
+			return
+		}
+		if err := os.WriteFile(b.path, data, 0o644); err != nil {
+			log.Printf("Warning: write fixture failed: %v", err)
+			return
+		}
+		log.Printf("Recorded upstream exchange to %s", b.path)
+	})
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range secretHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, redacted)
+		}
+	}
+	for i, cookie := range out.Values("Cookie") {
+		out["Cookie"][i] = redactCookies(cookie, "; ")
+	}
+	for i, cookie := range out.Values("Set-Cookie") {
+		// 只有第一段是 name=value，之后的 Path、Expires 等属性保留
+		value, attributes, _ := strings.Cut(cookie, ";")
+		out["Set-Cookie"][i] = redactCookies(value, "")
+		if attributes != "" {
+			out["Set-Cookie"][i] += ";" + attributes
+		}
+	}
+	return out
+}
+
+// redactCookies 把以 sep 分隔的 name=value 中的值替换为 REDACTED，sep 为空时只处理一个
+func redactCookies(cookies string, sep string) string {
+	parts := []string{cookies}
+	if sep != "" {
+		parts = strings.Split(cookies, sep)
+	}
+	for i, part := range parts {
+		name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+		parts[i] = name + "=" + redacted
+	}
+	return strings.Join(parts, sep)
+}
+
+// redactBody 脱敏 JSON 或 SSE 响应体中的凭据字段，其他内容原样保留。
+// 非 UTF-8 的内容（如上传的图片）无法脱敏，以 base64 保存
+func redactBody(body []byte) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if !utf8.Valid(body) {
+		return base64.StdEncoding.EncodeToString(body), base64Encoding
+	}
+	if out, ok := redactJSON(string(body)); ok {
+		return out, ""
+	}
+
+	lines := strings.Split(string(body), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if out, ok := redactJSON(strings.TrimPrefix(line, "data: ")); ok {
+			lines[i] = "data: " + out
+		}
+	}
+	return strings.Join(lines, "\n"), ""
+}
+
+func redactJSON(s string) (string, bool) {
+	var v interface{}
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil || decoder.More() {
+		return "", false
+	}
+	data, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+func redactValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if _, isString := item.(string); isString && secretFields[strings.ToLower(k)] {
+				val[k] = redacted
+				continue
+			}
+			val[k] = redactValue(item)
+		}
+	case []interface{}:
+		for i, item := range val {
+			val[i] = redactValue(item)
+		}
+	}
+	return v
+}
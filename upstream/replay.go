@@ -0,0 +1,91 @@
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ReplayTransport 按录制顺序回放 fixture 中的响应，不访问网络。
+// 请求按方法和路径匹配（忽略域名），同一路径的多次请求依次使用后续的录制
+type ReplayTransport struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	used      []bool
+}
+
+// NewReplayTransport 读取 dir 下所有 *.json fixture
+func NewReplayTransport(dir string) (*ReplayTransport, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no fixtures found in %s", dir)
+	}
+	sort.Strings(paths)
+
+	t := &ReplayTransport{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read fixture failed: %v", err)
+		}
+		var exchange Exchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			return nil, fmt.Errorf("unmarshal fixture %s failed: %v", path, err)
+		}
+		t.exchanges = append(t.exchanges, exchange)
+	}
+	t.used = make([]bool, len(t.exchanges))
+	return t, nil
+}
+
+func (t *ReplayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, exchange := range t.exchanges {
+		if t.used[i] || exchange.Request.Method != req.Method {
+			continue
+		}
+		recorded, err := url.Parse(exchange.Request.URL)
+		if err != nil || recorded.Path != req.URL.Path {
+			continue
+		}
+		body, err := exchange.ResponseBody()
+		if err != nil {
+			return nil, fmt.Errorf("decode recorded body for %s %s failed: %v", req.Method, req.URL.Path, err)
+		}
+		t.used[i] = true
+
+		header := exchange.Response.Header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", exchange.Response.Status, http.StatusText(exchange.Response.Status)),
+			StatusCode:    exchange.Response.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("no recorded response for %s %s", req.Method, req.URL.Path)
+}
@@ -0,0 +1,73 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/utils"
+)
+
+// RetryPolicy 上游请求在收到首字节前失败时的重试策略
+type RetryPolicy struct {
+	// MaxRetries 最多重试次数，0 表示不重试
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// RetryPolicyFromEnv 从环境变量读取重试策略
+func RetryPolicyFromEnv() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries: utils.GetEnvInt("MERLIN_RETRY_MAX", 2),
+		BaseDelay:  utils.GetEnvDuration("MERLIN_RETRY_BASE_DELAY", 200*time.Millisecond),
+		MaxDelay:   utils.GetEnvDuration("MERLIN_RETRY_MAX_DELAY", 5*time.Second),
+	}
+}
+
+// Backoff 返回第 attempt 次重试（从 1 开始）前的等待时间：指数增长，不超过 MaxDelay，
+// 并在 [d/2, d) 之间随机抖动，避免多个请求同时重试
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// Wait 等待第 attempt 次重试的退避时间，ctx 结束时提前返回错误
+func (p RetryPolicy) Wait(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(p.Backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Retryable 判断上游错误是否值得重试：连接错误、超时、429 和 5xx
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, ErrStreamIdle)
+}
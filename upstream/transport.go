@@ -0,0 +1,256 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rubleowen/GetMerlin2Api/metrics"
+	"github.com/rubleowen/GetMerlin2Api/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// ErrStreamIdle 表示上游在两次数据之间的静默时间超过了 StreamIdleTimeout
+var ErrStreamIdle = errors.New("upstream stream idle timeout")
+
+// Config 上游HTTP连接的参数
+type Config struct {
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	FirstByteTimeout    time.Duration
+	StreamIdleTimeout   time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConnsPerHost int
+	DNSCacheTTL         time.Duration
+	TLSClientConfig     *tls.Config
+	// RecordDir 不为空时把上游请求和响应脱敏后保存为 fixture
+	RecordDir string
+	// ReplayDir 不为空时从 fixture 回放响应，不访问网络
+	ReplayDir string
+}
+
+// ConfigFromEnv 从环境变量读取上游连接参数
+func ConfigFromEnv() Config {
+	return Config{
+		DialTimeout:         utils.GetEnvDuration("MERLIN_DIAL_TIMEOUT", 10*time.Second),
+		TLSHandshakeTimeout: utils.GetEnvDuration("MERLIN_TLS_TIMEOUT", 10*time.Second),
+		FirstByteTimeout:    utils.GetEnvDuration("MERLIN_FIRST_BYTE_TIMEOUT", 60*time.Second),
+		StreamIdleTimeout:   utils.GetEnvDuration("MERLIN_STREAM_IDLE_TIMEOUT", 180*time.Second),
+		IdleConnTimeout:     utils.GetEnvDuration("MERLIN_IDLE_CONN_TIMEOUT", 90*time.Second),
+		MaxIdleConnsPerHost: 32,
+		DNSCacheTTL:         utils.GetEnvDuration("MERLIN_DNS_CACHE_TTL", 5*time.Minute),
+		RecordDir:           utils.GetEnvOrDefault("MERLIN_RECORD_DIR", ""),
+		ReplayDir:           utils.GetEnvOrDefault("MERLIN_REPLAY_DIR", ""),
+	}
+}
+
+var (
+	sharedOnce   sync.Once
+	sharedErr    error
+	sharedMu     sync.RWMutex
+	sharedClient *http.Client
+)
+
+// errTransport 共享客户端创建失败时使用，每个请求都返回创建时的错误，不会退化为直接访问网络
+type errTransport struct {
+	err error
+}
+
+func (t errTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	return nil, t.err
+}
+
+func initShared() {
+	sharedOnce.Do(func() {
+		client, err := New(ConfigFromEnv())
+		if err != nil {
+			sharedErr = err
+			client = &http.Client{Transport: errTransport{err: err}}
+		}
+		sharedMu.Lock()
+		sharedClient = client
+		sharedMu.Unlock()
+	})
+}
+
+// Init 按环境变量创建共享客户端，回放 fixture 无法加载等配置错误在启动时返回
+func Init() error {
+	initShared()
+	return sharedErr
+}
+
+// Client 返回所有上游请求共用的HTTP客户端，连接在请求之间复用
+func Client() *http.Client {
+	initShared()
+	sharedMu.RLock()
+	defer sharedMu.RUnlock()
+	return sharedClient
+}
+
+// SetClient 替换共享客户端（例如换成回放客户端），返回的函数用于恢复原客户端
+func SetClient(client *http.Client) func() {
+	previous := Client()
+	sharedMu.Lock()
+	sharedClient = client
+	sharedMu.Unlock()
+	return func() {
+		sharedMu.Lock()
+		sharedClient = previous
+		sharedMu.Unlock()
+	}
+}
+
+// New 根据配置创建支持 HTTP/2、连接池和DNS缓存的客户端，回放 fixture 无法加载时返回错误
+func New(cfg Config) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           newDNSCache(cfg.DNSCacheTTL).dialContext(dialer),
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		TLSClientConfig:       cfg.TLSClientConfig,
+		ResponseHeaderTimeout: cfg.FirstByteTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if cfg.DNSCacheTTL <= 0 {
+		transport.DialContext = dialer.DialContext
+	}
+
+	var base http.RoundTripper = &idleTimeoutTransport{base: transport, idle: cfg.StreamIdleTimeout}
+	if cfg.ReplayDir != "" {
+		replay, err := NewReplayTransport(cfg.ReplayDir)
+		if err != nil {
+			return nil, fmt.Errorf("load replay fixtures: %w", err)
+		}
+		log.Printf("Replaying upstream responses from %s", cfg.ReplayDir)
+		base = replay
+	}
+	if cfg.RecordDir != "" {
+		log.Printf("Recording upstream exchanges to %s", cfg.RecordDir)
+		base = newRecordTransport(base, cfg.RecordDir)
+	}
+
+	// 上游请求作为子 span 记录，但不注入 traceparent，避免破坏浏览器特征
+	traced := otelhttp.NewTransport(
+		base,
+		otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+	)
+
+	return &http.Client{
+		Transport: &metricsTransport{base: traced, pool: transport},
+	}, nil
+}
+
+// Prewarm 提前建立到上游的连接，减少第一个请求的握手延迟
+func Prewarm(ctx context.Context, client *http.Client, urls ...string) {
+	var wg sync.WaitGroup
+	for _, url := range urls {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+			if err != nil {
+				return
+			}
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				log.Printf("Prewarm %s failed: %v", url, err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			log.Printf("Prewarmed %s (%s) in %v", url, resp.Proto, time.Since(start))
+		}(url)
+	}
+	wg.Wait()
+}
+
+// metricsTransport 按上游域名统计响应状态码
+type metricsTransport struct {
+	base http.RoundTripper
+	pool *http.Transport
+}
+
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		metrics.UpstreamResponsesTotal.WithLabelValues(req.URL.Hostname(), "error").Inc()
+		return resp, err
+	}
+	metrics.UpstreamResponsesTotal.WithLabelValues(req.URL.Hostname(), strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// CloseIdleConnections 让 http.Client.CloseIdleConnections 能作用到底层连接池
+func (t *metricsTransport) CloseIdleConnections() {
+	t.pool.CloseIdleConnections()
+}
+
+// idleTimeoutTransport 为响应体加上读取空闲超时，用于检测卡住的SSE流
+type idleTimeoutTransport struct {
+	base http.RoundTripper
+	idle time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.idle <= 0 {
+		return resp, err
+	}
+	resp.Body = newIdleTimeoutBody(resp.Body, t.idle)
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	rc       io.ReadCloser
+	idle     time.Duration
+	timer    *time.Timer
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutBody(rc io.ReadCloser, idle time.Duration) *idleTimeoutBody {
+	b := &idleTimeoutBody{rc: rc, idle: idle}
+	b.timer = time.AfterFunc(idle, func() {
+		b.timedOut.Store(true)
+		b.rc.Close()
+	})
+	b.timer.Stop()
+	return b
+}
+
+// Read 只在等待上游数据时计时，下游写入慢不会触发超时
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.idle)
+	n, err := b.rc.Read(p)
+	b.timer.Stop()
+	if err != nil && b.timedOut.Load() {
+		return n, ErrStreamIdle
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.rc.Close()
+}
@@ -3,6 +3,8 @@ package utils
 import (
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -16,6 +18,34 @@ func GetEnvOrDefault(key, defaultVal string) string {
 	return val
 }
 
+// GetEnvDuration 从环境变量中读取时长(如 "30s"),不存在或格式错误时返回默认值
+func GetEnvDuration(key string, defaultVal time.Duration) time.Duration {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return defaultVal
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Printf("Warning: invalid duration %s=%q, using default %s", key, val, defaultVal)
+		return defaultVal
+	}
+	return d
+}
+
+// GetEnvInt 从环境变量中读取整数,不存在或格式错误时返回默认值
+func GetEnvInt(key string, defaultVal int) int {
+	val, ok := os.LookupEnv(key)
+	if !ok || val == "" {
+		return defaultVal
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Printf("Warning: invalid integer %s=%q, using default %d", key, val, defaultVal)
+		return defaultVal
+	}
+	return n
+}
+
 func LoadEnv() {
 	err := godotenv.Load()
 	if err != nil {